@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -12,14 +14,27 @@ const (
 	Err_ImmutableResource = "Cannot update %s as it is already schedule or published."
 	Err_CreateResource    = "Could not create %s."
 	Err_FileNotFound      = "File or directory '%s' does not exist."
+	Err_ProbeAnimation    = "Could not probe '%s' for animation (%v)."
 )
 
 type AddOptions struct {
-	Artist   string `opt:"-a"`
-	By       string `opt:"-by"`
-	Name     string `opt:"-n"`
-	Desc     string `opt:"-d"`
-	MoveFile bool   `opt:"-mv"`
+	Artist   string  `opt:"-a"`
+	By       string  `opt:"-by"`
+	Name     string  `opt:"-n"`
+	Desc     string  `opt:"-d"`
+	MoveFile bool    `opt:"-mv"`
+	Profile  string  `opt:"-p"`
+	Viz      string  `opt:"-viz"`
+	Set      string  `opt:"-set"`
+	Seconds  int     `opt:"-t"`
+	Motion   string  `opt:"-motion"`
+	Speed    float64 `opt:"-speed"`
+	Focus    string  `opt:"-focus"`
+	Start    float64 `opt:"-start"`
+	End      float64 `opt:"-end"`
+	FadeIn   float64 `opt:"-fadein"`
+	FadeOut  float64 `opt:"-fadeout"`
+	Trim     bool    `opt:"-trim"`
 }
 
 type AddCommand struct {
@@ -27,13 +42,21 @@ type AddCommand struct {
 	SrcPath        string
 	DataDir        string
 	Download       DownloadCommand
-	Options        AddOptions
+	// Used to probe animated artwork
+	Editor Editor
+	// Print the files that would be added without adding them
+	DryRun  bool
+	Options AddOptions
 }
 
-func (self *AddCommand) Exec(c *Collections) {
+// Add files to a collection. Adding stops at the first file that cannot
+// be downloaded, the files added before it are kept.
+func (self *AddCommand) Exec(ctx context.Context, c *Collections) error {
 	paths := listFilePaths(self.SrcPath)
 	dst := path.Join(self.DataDir, self.CollectionName)
-	os.MkdirAll(dst, os.ModePerm)
+	if !self.DryRun {
+		os.MkdirAll(dst, os.ModePerm)
+	}
 
 	switch self.CollectionName {
 	case "music":
@@ -45,12 +68,15 @@ func (self *AddCommand) Exec(c *Collections) {
 			c.Tracks = c.Tracks[:len(c.Tracks)-1]
 
 			// Remove track from disk
-			os.Remove(track.Path)
+			removeFile(track.Path, self.DryRun)
 			userLog("undo:", track.Path)
-			return
+			return nil
 		}
 		for _, p := range paths {
-			self.execAddMusic(c, p, dst)
+			if ctx.Err() != nil {
+				return nil
+			}
+			self.execAddMusic(ctx, c, p, dst)
 		}
 	case "art":
 		if len(paths) > 0 && paths[0] == "undo" {
@@ -61,36 +87,116 @@ func (self *AddCommand) Exec(c *Collections) {
 			c.Artwork = c.Artwork[:len(c.Artwork)-1]
 
 			// Remove artwork from disk
-			os.Remove(art.Path)
+			removeFile(art.Path, self.DryRun)
+			if art.Original != "" {
+				removeFile(art.Original, self.DryRun)
+			}
 			userLog("undo:", art.Path)
-			return
+			return nil
 		}
 		for _, p := range paths {
-			self.execAddArtwork(c, p, dst)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := self.execAddArtwork(ctx, c, p, dst); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
-func (self *AddCommand) execAddMusic(c *Collections, src, dst string) {
+func (self *AddCommand) execAddMusic(ctx context.Context, c *Collections, src, dst string) {
+	if self.DryRun {
+		track := newTrack(src, dst, self.Options)
+		if !fileExists(src) {
+			userError(Err_FileNotFound, src)
+		}
+		self.planFile(src, track.Path)
+		if self.Options.Trim {
+			userLog("trim:", "detect silence in %s", track.Path)
+		}
+		AddTrack(c, *track)
+		userLog("state:", "%s: new -> %s", track.Path, ItemState(Buffered))
+		return
+	}
 	track, err := NewTrack(src, dst, self.Options)
 
 	if err != nil {
 		userError(Err_CreateResource, "music")
 	}
+	trimSilence(ctx, &self.Editor, track, self.Options)
 	AddTrack(c, *track)
 }
 
-func (self *AddCommand) execAddArtwork(c *Collections, src, dst string) {
-	if isUrl(src) {
-		src = self.Download.GetArtwork(src)
+// Trim leading and trailing silence from a track when requested, trim
+// points given as options take priority over detected ones.
+func trimSilence(ctx context.Context, editor *Editor, track *Track, opt AddOptions) {
+	if !opt.Trim {
+		return
+	}
+	trim, err := editor.DetectSilence(ctx, track.Path)
+	if err != nil {
+		userError(Err_DetectSilence, track.Path, err)
+	}
+	if opt.Start == 0 {
+		track.Trim.Start = trim.Start
+	}
+	if opt.End == 0 {
+		track.Trim.End = trim.End
+	}
+	userLog("trim:", "%.2fs to %.2fs", track.Trim.Start, track.Trim.End)
+}
+
+func (self *AddCommand) execAddArtwork(ctx context.Context, c *Collections, src, dst string) error {
+	downloaded := isUrl(src)
+	if downloaded {
+		var err error
+		if src, err = self.Download.GetArtwork(ctx, src); err != nil {
+			return err
+		}
 		self.Options.MoveFile = true
 	}
+	if self.DryRun {
+		art := newArtwork(src, dst, self.Options)
+		if !downloaded && !fileExists(src) {
+			userError(Err_FileNotFound, src)
+		}
+		self.planFile(src, art.Path)
+		if format, _ := sniffImage(src); convertFormats[format] {
+			userLog("convert:", "%s -> png", art.Path)
+		}
+		AddArtwork(c, *art)
+		userLog("state:", "%s: new -> %s", art.Path, ItemState(Buffered))
+		return nil
+	}
 	art, err := NewArtwork(src, dst, self.Options)
 
 	if err != nil {
 		userError(Err_CreateResource, "artwork")
 	}
+
+	// Artwork that cannot be probed is still added as a still image
+	frames, loop, err := self.Editor.ProbeAnimation(art.Path)
+	if err != nil {
+		printError(Err_ProbeAnimation, art.Path, err)
+	}
+	art.Frames, art.LoopDuration = frames, loop
+	if frames > 0 {
+		userLog("animated:", "%d frames, %.2fs loop", frames, loop)
+	} else {
+		if err := self.Editor.ConvertArtwork(ctx, art); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf(Err_ConvertArtwork, art.Path, err)
+		}
+		if art.Original != "" {
+			userLog("convert:", art.Path)
+		}
+	}
 	AddArtwork(c, *art)
+	return nil
 }
 
 func listFilePaths(src string) []string {
@@ -111,24 +217,54 @@ func listFilePaths(src string) []string {
 	return []string{src}
 }
 
+// Print the copy or move of a file added to the collections
+func (self *AddCommand) planFile(src, dst string) {
+	op := "copy:"
+	if self.Options.MoveFile {
+		op = "move:"
+	}
+	if src != dst {
+		userLog(op, "%s -> %s", src, dst)
+	}
+}
+
+// Copy or move src to dst
+func placeFile(src, dst string, move bool) error {
+	if src == dst {
+		return nil
+	}
+	if move {
+		return os.Rename(src, dst)
+	}
+	_, err := fileCopy(src, dst)
+	return err
+}
+
 // Create artwork by copying or moving src file to a file in dst
 // directory with the same name.
 func NewArtwork(src, dst string, opt AddOptions) (*Artwork, error) {
-	file := filepath.Base(src)
-	dst = path.Join(dst, file)
+	art := newArtwork(src, dst, opt)
+	if err := placeFile(src, art.Path, opt.MoveFile); err != nil {
+		return nil, err
+	}
+	return art, nil
+}
 
-	if src != dst {
-		var err error
-		if opt.MoveFile {
-			os.Rename(src, dst)
-		} else {
-			_, err = fileCopy(src, dst)
-		}
-		if err != nil {
-			return nil, err
-		}
+// Artwork for src added to dst directory
+func newArtwork(src, dst string, opt AddOptions) *Artwork {
+	return &Artwork{
+		Artist:   opt.Artist,
+		Path:     path.Join(dst, filepath.Base(src)),
+		State:    Buffered,
+		Profile:  opt.Profile,
+		Set:      opt.Set,
+		Duration: float64(opt.Seconds),
+		Motion: Motion{
+			Preset: opt.Motion,
+			Speed:  opt.Speed,
+			Focus:  opt.Focus,
+		},
 	}
-	return &Artwork{opt.Artist, dst, Buffered}, nil
 }
 
 // Add artwork to collection. If an artwork with the same UniqueId already
@@ -155,6 +291,15 @@ func AddArtwork(c *Collections, artwork Artwork) {
 // Create track by copying or moving src file to a file in dst
 // directory with the same name.
 func NewTrack(src, dst string, opt AddOptions) (*Track, error) {
+	track := newTrack(src, dst, opt)
+	if err := placeFile(src, track.Path, opt.MoveFile); err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+// Track for src added to dst directory
+func newTrack(src, dst string, opt AddOptions) *Track {
 	file := filepath.Base(src)
 	// Try to infer track name and artist
 	title, artist := trackInfo(file)
@@ -168,21 +313,25 @@ func NewTrack(src, dst string, opt AddOptions) (*Track, error) {
 	}
 
 	dst = path.Join(dst, file)
-	var err error
-
-	if opt.MoveFile {
-		err = os.Rename(src, dst)
-	} else {
-		_, err = fileCopy(src, dst)
-	}
-	if err != nil {
-		return nil, err
-	}
-
 	artists := inferArtists(title, artist, opt)
 
 	// By default no description is added
-	return &Track{title, artist, artists, opt.Desc, dst, Buffered}, nil
+	return &Track{
+		Title:       title,
+		By:          artist,
+		Artists:     artists,
+		Description: opt.Desc,
+		Path:        dst,
+		State:       Buffered,
+		Profile:     opt.Profile,
+		Visualizer:  opt.Viz,
+		Trim: Trim{
+			Start:   opt.Start,
+			End:     opt.End,
+			FadeIn:  opt.FadeIn,
+			FadeOut: opt.FadeOut,
+		},
+	}
 }
 
 // Add track to collection. If an artwork with the same UniqueId already
@@ -242,7 +391,7 @@ func updateArtists(c *Collections, artists ...string) {
 	for _, artist := range artists {
 		_, ok := c.Find(strings.ToLower(artist))
 		if ok {
-			return
+			continue
 		}
 		c.Artists = append(c.Artists, &Artist{artist, []string{}})
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Extensions of video files that are used as looping artwork
+var videoLoopFormats = [...]string{".mp4", ".webm", ".mov", ".mkv"}
+
+// Detect animated artwork, returning the number of frames and the
+// duration of one loop in seconds. Still images return zero frames.
+func (self *Editor) ProbeAnimation(path string) (int, float64, error) {
+	format, err := sniffImage(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch format {
+	case "gif":
+		return gifAnimation(path)
+	case "webp":
+		// Probed below for more than one frame
+	case "":
+		ext := strings.ToLower(filepath.Ext(path))
+		animated := false
+		for _, e := range videoLoopFormats {
+			if ext == e {
+				animated = true
+				break
+			}
+		}
+		if !animated {
+			return 0, 0, nil
+		}
+	default:
+		return 0, 0, nil
+	}
+
+	info, err := self.Probe(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	stream, ok := info.Stream("video")
+	if !ok {
+		return 0, 0, nil
+	}
+
+	duration, _ := strconv.ParseFloat(stream.Duration, 64)
+	if duration <= 0 {
+		duration = info.Duration()
+	}
+	frames, _ := strconv.Atoi(stream.NbFrames)
+	if frames == 0 {
+		// Containers such as webm do not store a frame count
+		frames = int(duration*parseRate(stream.AvgFrameRate) + 0.5)
+	}
+	if frames < 2 || duration <= 0 {
+		return 0, 0, nil
+	}
+	return frames, duration, nil
+}
+
+func gifAnimation(path string) (int, float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	img, err := gif.DecodeAll(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(img.Image) < 2 {
+		return 0, 0, nil
+	}
+
+	// Delays are in hundredths of a second, browsers and ffmpeg show
+	// frames without a delay for 0.1s.
+	duration := 0.0
+	for _, d := range img.Delay {
+		if d <= 1 {
+			d = 10
+		}
+		duration += float64(d) / 100
+	}
+	return len(img.Image), duration, nil
+}
+
+// Parse an ffprobe frame rate such as 30000/1001
+func parseRate(s string) float64 {
+	parts := strings.SplitN(s, "/", 2)
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return n
+	}
+	d, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+const (
+	Err_InvalidCanvas   = "Canvas size '%s' is not valid (expected WxH)."
+	Err_InvalidFitMode  = "Fit mode '%s' is not valid (expected pad, blur or crop)."
+	Err_InvalidPadColor = "Pad color '%s' is not valid (expected #rrggbb)."
+)
+
+const (
+	FitNone = ""
+	// Scale artwork to fit the canvas and fill the rest with PadColor
+	FitPad = "pad"
+	// Like pad but fill the rest with a blurred and darkened copy of
+	// the artwork.
+	FitBlur = "blur"
+	// Scale artwork to cover the canvas, cropping the least detailed
+	// parts of the image.
+	FitCrop = "crop"
+)
+
+// Fit artwork to the editor canvas. The processed frame is cached in
+// cacheDir and reused as long as the artwork file and fit settings do
+// not change. Returns the path to the image that should be rendered.
+// Animated artwork is scaled and padded to the canvas while rendering
+// instead.
+func (self *Editor) PrepareArtwork(ctx context.Context, art *Artwork, cacheDir string) (string, error) {
+	if self.Fit == FitNone || art.FrameRate() > 0 {
+		return art.Path, nil
+	}
+
+	w, h, err := parseCanvas(self.Canvas)
+	if err != nil {
+		return "", err
+	}
+	bg, err := parseColor(self.PadColor)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(art.Path)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s:%d:%d:%dx%d:%s:%s",
+		art.Path, info.Size(), info.ModTime().UnixNano(),
+		w, h, self.Fit, self.PadColor)
+	sum := sha1.Sum([]byte(key))
+	dst := filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+".png")
+
+	if fileExists(dst) {
+		art.Frame = dst
+		return dst, nil
+	}
+
+	src, err := self.decodeImage(ctx, art.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var frame *image.RGBA
+	switch self.Fit {
+	case FitPad:
+		frame = fitPad(src, w, h, bg)
+	case FitBlur:
+		frame = fitBlur(src, w, h)
+	case FitCrop:
+		frame = fitCrop(src, w, h)
+	default:
+		return "", fmt.Errorf(Err_InvalidFitMode, self.Fit)
+	}
+
+	os.MkdirAll(cacheDir, os.ModePerm)
+	if err := writePng(dst, frame); err != nil {
+		return "", err
+	}
+	art.Frame = dst
+	return dst, nil
+}
+
+// Decode an image file, formats not supported by the standard library
+// are converted to png with ffmpeg first.
+func (self *Editor) decodeImage(ctx context.Context, path string) (image.Image, error) {
+	if img, err := readImage(path); err == nil {
+		return img, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "autoyt-*.png")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{"-y", "-i", path, "-frames:v", "1", tmp.Name()}
+	if err := runFfmpeg(ctx, self.Path, args, 0, "", nil); err != nil {
+		return nil, err
+	}
+	return readImage(tmp.Name())
+}
+
+func readImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// Encode image to a temporary file first so a partially written frame
+// is never mistaken for a cached one.
+func writePng(path string, img image.Image) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func fitPad(src image.Image, w, h int, bg color.Color) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	drawContained(dst, src)
+	return dst
+}
+
+func fitBlur(src image.Image, w, h int) *image.RGBA {
+	// Blur a small copy of the artwork, scaling it back up smooths out
+	// the blur further and is much cheaper than blurring at full size.
+	bw, bh := maxInt(w/16, 1), maxInt(h/16, 1)
+	sw, sh := coverSize(src.Bounds(), bw, bh)
+	small := resize(src, sw, sh)
+	boxBlur(small, 2)
+	boxBlur(small, 2)
+
+	x := (sw - bw) / 2
+	y := (sh - bh) / 2
+	crop := small.SubImage(image.Rect(x, y, x+bw, y+bh))
+	dst := resize(crop, w, h)
+	dim(dst, 0.5)
+	drawContained(dst, src)
+	return dst
+}
+
+func fitCrop(src image.Image, w, h int) *image.RGBA {
+	cw, ch := coverSize(src.Bounds(), w, h)
+	scaled := resize(src, cw, ch)
+	r := entropyCrop(scaled, w, h)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), scaled, r.Min, draw.Src)
+	return dst
+}
+
+// Draw src scaled down or up to fit inside dst, centered
+func drawContained(dst *image.RGBA, src image.Image) {
+	b := dst.Bounds()
+	fw, fh := containSize(src.Bounds(), b.Dx(), b.Dy())
+	fg := resize(src, fw, fh)
+	x := (b.Dx() - fw) / 2
+	y := (b.Dy() - fh) / 2
+	r := image.Rect(x, y, x+fw, y+fh)
+	draw.Draw(dst, r, fg, image.Point{}, draw.Over)
+}
+
+// Largest size with the aspect ratio of r that fits inside w by h
+func containSize(r image.Rectangle, w, h int) (int, int) {
+	scale := math.Min(float64(w)/float64(r.Dx()), float64(h)/float64(r.Dy()))
+	sw := int(math.Round(float64(r.Dx()) * scale))
+	sh := int(math.Round(float64(r.Dy()) * scale))
+	return maxInt(minInt(sw, w), 1), maxInt(minInt(sh, h), 1)
+}
+
+// Smallest size with the aspect ratio of r that covers w by h
+func coverSize(r image.Rectangle, w, h int) (int, int) {
+	scale := math.Max(float64(w)/float64(r.Dx()), float64(h)/float64(r.Dy()))
+	sw := int(math.Round(float64(r.Dx()) * scale))
+	sh := int(math.Round(float64(r.Dy()) * scale))
+	return maxInt(sw, w), maxInt(sh, h)
+}
+
+// Find the w by h window in img with the highest luminance entropy.
+// The window only moves along the axis where img is larger than the
+// window, since the image was scaled to cover it.
+func entropyCrop(img *image.RGBA, w, h int) image.Rectangle {
+	b := img.Bounds()
+	slackX := maxInt(b.Dx()-w, 0)
+	slackY := maxInt(b.Dy()-h, 0)
+	best := image.Rect(slackX/2, slackY/2, slackX/2+w, slackY/2+h).Add(b.Min)
+
+	if slackX == 0 && slackY == 0 {
+		return best
+	}
+
+	// A window only replaces the centered one if it is noticeably more
+	// detailed, this avoids odd crops of evenly detailed artwork.
+	const steps = 16
+	bestEntropy := entropy(img, best) + 0.05
+	for i := 0; i <= steps; i++ {
+		x := slackX * i / steps
+		y := slackY * i / steps
+		r := image.Rect(x, y, x+w, y+h).Add(b.Min)
+		if e := entropy(img, r); e > bestEntropy {
+			bestEntropy = e
+			best = r
+		}
+	}
+	return best
+}
+
+// Shannon entropy of the luminance histogram of a region. Only every
+// 4th pixel is sampled, which is plenty for comparing regions.
+func entropy(img *image.RGBA, r image.Rectangle) float64 {
+	var hist [256]int
+	total := 0
+	for y := r.Min.Y; y < r.Max.Y; y += 4 {
+		for x := r.Min.X; x < r.Max.X; x += 4 {
+			i := img.PixOffset(x, y)
+			p := img.Pix[i : i+3 : i+3]
+			lum := (299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000
+			hist[lum]++
+			total++
+		}
+	}
+
+	e := 0.0
+	for _, n := range hist {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(total)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// Resize an image with bilinear filtering. When scaling down by more
+// than half the image is first halved to avoid aliasing.
+func resize(src image.Image, w, h int) *image.RGBA {
+	img := toRGBA(src)
+	for img.Bounds().Dx() >= w*2 && img.Bounds().Dy() >= h*2 {
+		img = halve(img)
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sx := float64(b.Dx()) / float64(w)
+	sy := float64(b.Dy()) / float64(h)
+
+	for y := 0; y < h; y++ {
+		fy := math.Max((float64(y)+0.5)*sy-0.5, 0)
+		y0 := int(fy)
+		y1 := minInt(y0+1, b.Dy()-1)
+		ty := fy - float64(y0)
+
+		for x := 0; x < w; x++ {
+			fx := math.Max((float64(x)+0.5)*sx-0.5, 0)
+			x0 := int(fx)
+			x1 := minInt(x0+1, b.Dx()-1)
+			tx := fx - float64(x0)
+
+			p00 := img.PixOffset(b.Min.X+x0, b.Min.Y+y0)
+			p10 := img.PixOffset(b.Min.X+x1, b.Min.Y+y0)
+			p01 := img.PixOffset(b.Min.X+x0, b.Min.Y+y1)
+			p11 := img.PixOffset(b.Min.X+x1, b.Min.Y+y1)
+			d := dst.PixOffset(x, y)
+
+			for c := 0; c < 4; c++ {
+				top := float64(img.Pix[p00+c])*(1-tx) + float64(img.Pix[p10+c])*tx
+				bot := float64(img.Pix[p01+c])*(1-tx) + float64(img.Pix[p11+c])*tx
+				dst.Pix[d+c] = uint8(top*(1-ty) + bot*ty + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// Downscale an image by half averaging each 2x2 block of pixels
+func halve(src *image.RGBA) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx()/2, b.Dy()/2
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := src.PixOffset(b.Min.X+x*2, b.Min.Y+y*2)
+			q := p + src.Stride
+			d := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				sum := int(src.Pix[p+c]) + int(src.Pix[p+4+c]) +
+					int(src.Pix[q+c]) + int(src.Pix[q+4+c])
+				dst.Pix[d+c] = uint8((sum + 2) / 4)
+			}
+		}
+	}
+	return dst
+}
+
+// Blur image in place by averaging pixels within radius horizontally
+// then vertically. Applying it more than once approximates a gaussian.
+func boxBlur(img *image.RGBA, radius int) {
+	b := img.Bounds()
+	tmp := make([]uint8, len(img.Pix))
+
+	blur := func(src, dst []uint8, n, lines int, offset func(line, i int) int) {
+		for l := 0; l < lines; l++ {
+			for i := 0; i < n; i++ {
+				var sum [4]int
+				count := 0
+				for k := maxInt(i-radius, 0); k <= minInt(i+radius, n-1); k++ {
+					p := offset(l, k)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src[p+c])
+					}
+					count++
+				}
+				d := offset(l, i)
+				for c := 0; c < 4; c++ {
+					dst[d+c] = uint8(sum[c] / count)
+				}
+			}
+		}
+	}
+
+	blur(img.Pix, tmp, b.Dx(), b.Dy(), func(y, x int) int {
+		return y*img.Stride + x*4
+	})
+	blur(tmp, img.Pix, b.Dy(), b.Dx(), func(x, y int) int {
+		return y*img.Stride + x*4
+	})
+}
+
+// Multiply color channels by f
+func dim(img *image.RGBA, f float64) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8(float64(img.Pix[i+c]) * f)
+		}
+	}
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	if img, ok := src.(*image.RGBA); ok {
+		return img
+	}
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	return img
+}
+
+// Parse a WxH size, dimensions are rounded down to even numbers since
+// most video encoders require it.
+func parseCanvas(s string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf(Err_InvalidCanvas, s)
+	}
+	w, errW := strconv.Atoi(strings.TrimSpace(parts[0]))
+	h, errH := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errW != nil || errH != nil || w < 2 || h < 2 {
+		return 0, 0, fmt.Errorf(Err_InvalidCanvas, s)
+	}
+	return w &^ 1, h &^ 1, nil
+}
+
+func parseColor(s string) (color.RGBA, error) {
+	if s == "" {
+		return color.RGBA{0, 0, 0, 255}, nil
+	}
+	rgb := strings.TrimPrefix(s, "#")
+	v, err := strconv.ParseUint(rgb, 16, 32)
+	if err != nil || len(rgb) != 6 {
+		return color.RGBA{}, fmt.Errorf(Err_InvalidPadColor, s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
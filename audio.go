@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+const Err_InvalidAudioCodec = "Audio codec '%s' is not valid (expected aac or opus)."
+
+const (
+	AudioAAC  = "aac"
+	AudioOpus = "opus"
+)
+
+// Audio codecs that can be copied into the output without transcoding
+var copyAudioCodecs = map[string]bool{
+	"aac": true,
+	"mp3": true,
+}
+
+// Arguments selecting the output audio codec. Audio is copied when the
+// track is already AAC or MP3 and no filter changes it, otherwise it is
+// transcoded to AudioCodec at AudioBitrate. An audio codec set in
+// OutputArgs is ignored.
+func (self *Editor) audioArgs(codec string, filtered bool) ([]string, error) {
+	if copyAudioCodecs[codec] && !filtered {
+		return []string{"-c:a", "copy"}, nil
+	}
+
+	bitrate := self.AudioBitrate
+	switch self.AudioCodec {
+	case "", AudioAAC:
+		if bitrate == "" {
+			bitrate = "320k"
+		}
+		return []string{"-c:a", "aac", "-b:a", bitrate}, nil
+	case AudioOpus:
+		if bitrate == "" {
+			bitrate = "192k"
+		}
+		return []string{"-c:a", "libopus", "-b:a", bitrate}, nil
+	}
+	return nil, fmt.Errorf(Err_InvalidAudioCodec, self.AudioCodec)
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -19,12 +22,21 @@ const (
 	Err_ConfigParse      = "Failed to parse config file: %s.\n%v"
 	Err_MissingOption    = "Expected value for option '%s'."
 	Err_IncorrectOptType = "Expected %s value from option '%s'."
+	Err_UnknownProfile   = "Unknown render profile '%s'."
+	Err_InvalidTimeout   = "Timeout %s is not valid (expected a duration like 90s or 2h)."
+	Err_Timeout          = "Timed out after %s."
 	DefaultConfigPath    = "~/.autoyt/config.json"
 )
 
 const Usage = `
 Usage: autoyt [command] [options]
 
+options:
+    --dry-run             Print the files, ffmpeg commands and uploads
+                          add, schedule and upload would make, and the
+                          changes to the collections, without making them.
+                          Exits with an error if any of them would fail.
+
 commands:
     add f [path]          Add music or art to buffer
         f                 Can be either music, art or undo
@@ -39,6 +51,46 @@ commands:
         -d <description>  Add a description to the music. This value will
                           be appended to the video description.
         -mv               Move file from path instead of copying it.
+        -p <profile>      Render profile used for videos with this music
+                          or art.
+        -viz <preset>     Audio visualizer drawn over the artwork, one of
+                          wave, circle, freqs or none.
+        -set <name>       Show art added one after another to the same set
+                          as a slideshow in a single video.
+        -t <seconds>      Show art in a slideshow for a number of seconds,
+                          by default the track is split evenly.
+        -motion <preset>  Zoom or pan over the art, one of zoom-in,
+                          zoom-out, pan, drift or none.
+        -speed <N>        Speed of the motion (default=1).
+        -focus <x,y>      Point zooms are centered on, as fractions of the
+                          art size (default=0.5,0.5).
+        -start <seconds>  Start the music at an offset.
+        -end <seconds>    End the music at an offset from its start.
+        -fadein <seconds> Fade in the music.
+        -fadeout <seconds>
+                          Fade out the music.
+        -trim             Cut silence at the start and end of the music.
+
+    edit f                Change music or art in the buffer.
+        f                 Can be either music or art.
+        -i <N>            Edit a specific item (default=1, the latest).
+        -a <artists>      Set the names for the artists (comma separated).
+        -by <artist>      Set the 'by' part of the track title.
+        -n <name>         Set the 'name' part of the track title.
+        -d <description>  Set the music description.
+        -p <profile>      Set the render profile.
+        -viz <preset>     Set the audio visualizer.
+        -set <name>       Set the slideshow set of the art.
+        -t <seconds>      Set the slideshow duration of the art.
+        -motion <preset>  Set the motion preset of the art.
+        -speed <N>        Set the speed of the motion.
+        -focus <x,y>      Set the point zooms are centered on.
+        -start <seconds>  Set the offset the music starts at.
+        -end <seconds>    Set the offset the music ends at.
+        -fadein <seconds> Set the fade in duration.
+        -fadeout <seconds>
+                          Set the fade out duration.
+        -trim             Cut silence at the start and end of the music.
 
     desc [items...]       Preview or make changes to video descriptions
                           before they are scheduled or published.
@@ -58,6 +110,44 @@ commands:
         f                 Can be one of undo or list. Undo deletes the
                           scheduled video. List shows scheduled videos.
         -s                Print shorter version of list.
+        -p <profile>      Render all videos using a specific profile,
+                          overriding profiles set on music and art.
+        -j <N>            Number of videos to render at the same time
+                          (default=1).
+        --shorts          Also render a vertical short of the most intense
+                          part of each track, published after the video.
+        --force-render    Render videos even when an identical render is
+                          cached.
+
+    mix                   Render buffered music as a single video with a
+                          chapter for each track and schedule it.
+        -n <title>        Title of the mix.
+        -c <N>            Number of tracks in the mix, starting with the
+                          oldest buffered music (default=all).
+        -x <seconds>      Crossfade between tracks.
+        -cue <path>       Add the audio file of a cue sheet and render it
+                          with a chapter for each track in the sheet.
+        -set <name>       Show the buffered art in a set as a slideshow,
+                          by default the latest art is shown.
+        -p <profile>      Render profile used for the mix.
+
+    loudness              Measure the loudness of buffered music and list
+                          tracks outside the target loudness.
+        -p <profile>      Use the loudness target of a render profile.
+        -f                Measure tracks that were already measured.
+
+    gc                    Remove cached renders not used by scheduled videos.
+        -age <duration>   Keep cached renders used within a duration
+                          (default=168h).
+
+    render-worker         Render videos sent by schedule and mix from other
+                          machines listed in the Workers config. Videos are
+                          rendered with the profiles configured on this
+                          machine. A Worker.Token is required unless
+                          listening on localhost.
+        -addr <host:port> Address to listen on (default=localhost:8090).
+        -j <N>            Number of videos to render at the same time
+                          (default=1).
 
     upload                Upload all scheduled videos to YouTube.
     status                Print number of scheduled and published videos.
@@ -69,11 +159,56 @@ type Config struct {
 	DataPath        string
 	CollectionsPath string
 	Ffmpeg          Editor
+	Profiles        map[string]Editor
+	DefaultProfile  string
+	Branding        Branding
 	VideoFormat     VideoFormat
 	ClientSecret    string
 	Metadata        UploadMetadata
 	UploadFrequency int
 	UploadTimeUTC   string
+	Timeouts        Timeouts
+	Shorts          Shorts
+	// Workers schedule dispatches videos to, and the settings used when
+	// running as a worker.
+	Workers []RemoteWorker
+	Worker  WorkerConfig
+}
+
+// Maximum duration of a single render, upload or download, an empty
+// value means no timeout.
+type Timeouts struct {
+	Render   string
+	Upload   string
+	Download string
+}
+
+// Timeouts parsed once at startup, zero means no timeout
+type timeoutDurations struct {
+	render   time.Duration
+	upload   time.Duration
+	download time.Duration
+}
+
+// Parse every timeout, an invalid timeout is reported before any
+// command starts.
+func (self *Timeouts) parse() timeoutDurations {
+	return timeoutDurations{
+		render:   parseTimeout(self.Render),
+		upload:   parseTimeout(self.Upload),
+		download: parseTimeout(self.Download),
+	}
+}
+
+func parseTimeout(timeout string) time.Duration {
+	if timeout == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d < 0 {
+		userError(Err_InvalidTimeout, timeout)
+	}
+	return d
 }
 
 var configPaths = []string{
@@ -88,14 +223,67 @@ var defaultConfig = Config{
 	CollectionsPath: "~/.autoyt/collections.json",
 	ClientSecret:    "~/.autoyt/client_secret.json",
 	Ffmpeg: Editor{
-		Path:       "ffmpeg",
-		InputArgs:  "-r 1 -loop 1",
-		OutputArgs: "-acodec copy -r 1 -shortest",
-		FileFormat: ".mp4",
+		Path:           "ffmpeg",
+		ProbePath:      "ffprobe",
+		InputArgs:      "-r 1 -loop 1",
+		OutputArgs:     "-r 1 -shortest -movflags +faststart",
+		LoopInputArgs:  "-stream_loop -1",
+		LoopOutputArgs: "-c:v libx264 -pix_fmt yuv420p -shortest -movflags +faststart",
+		AudioCodec:     "aac",
+		AudioBitrate:   "320k",
+		Silence: Silence{
+			Threshold: -50,
+			Duration:  0.5,
+		},
+		Loudness: Loudness{
+			Enabled:  false,
+			Target:   -14,
+			TruePeak: -1,
+			Range:    11,
+			Window:   2,
+		},
+		FileFormat:     ".mp4",
+		Canvas:         "1920x1080",
+		Fit:            "pad",
+		PadColor:       "#000000",
+		FrameRate:      25,
+		SlideCrossfade: 1,
+		Motion: Motion{
+			Preset:      "",
+			Speed:       1,
+			Focus:       "0.5,0.5",
+			MaxDuration: 600,
+		},
+		Metadata: &Metadata{
+			Enabled: true,
+			Cover:   true,
+		},
+		Verify: &Verify{
+			Enabled:   true,
+			Tolerance: 2,
+		},
+	},
+	Profiles:       map[string]Editor{},
+	DefaultProfile: "",
+	Branding: Branding{
+		Watermark: Watermark{
+			Position: "top-right",
+			Opacity:  0.8,
+			Scale:    0.08,
+			Margin:   32,
+		},
+		Crossfade:  0.5,
+		FrameRate:  25,
+		OutputArgs: "-c:v libx264 -pix_fmt yuv420p -c:a aac -b:a 320k -movflags +faststart",
 	},
 	VideoFormat: VideoFormat{
 		Title:          "%(by) - %(title)",
 		Header:         "%(by) - %(title)",
+		MixTitle:       "%(title)",
+		ShortTitle:     "%(by) - %(title) #shorts",
+		FileName:       "%(video)",
+		Chapter:        "%(time) %(by) - %(title)",
+		Album:          "",
 		TrackCredits:   "%(artist)",
 		ArtworkCredits: "Artwork by %(artist)",
 		Link:           "- %(link)",
@@ -108,27 +296,63 @@ var defaultConfig = Config{
 	},
 	UploadFrequency: 1,
 	UploadTimeUTC:   "12:00:00",
+	Shorts: Shorts{
+		Canvas:   "1080x1920",
+		Fit:      "blur",
+		Duration: 45,
+		FadeIn:   0.5,
+		FadeOut:  1.5,
+		Delay:    "1h",
+	},
+	Timeouts: Timeouts{
+		Render:   "",
+		Upload:   "",
+		Download: "5m",
+	},
+	Workers: []RemoteWorker{},
+	Worker: WorkerConfig{
+		Addr:         "localhost:8090",
+		Token:        "",
+		SharedRoots:  []string{},
+		MaxRequestMB: 4096,
+	},
 }
 
 func main() {
 	args := os.Args[1:]
 	help := Usage[1 : len(Usage)-1]
+	dryRun := removeFlag(&args, "--dry-run")
 	if len(args) == 0 {
 		fmt.Println(help)
 		os.Exit(1)
 	}
 
 	config := readConfig()
+	timeouts := config.Timeouts.parse()
 	collections := readCollections(expandHomePath(config.CollectionsPath))
+	if dryRun {
+		switch args[0] {
+		case "edit", "mix", "loudness", "gc", "render-worker":
+			userError(Err_DryRunUnsupported, args[0])
+		}
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	// Set when a command stopped early, the collections are still saved
+	failed := false
 
 	switch args[0] {
 	case "add":
 		opt := parseOptions(&args, AddOptions{}).(AddOptions)
 		dlopt := parseOptions(&args, DownloadOptions{}).(DownloadOptions)
 		expectArgs(args, "add", 3)
+		editor := expectProfile(config, opt.Profile)
 
 		download := DownloadCommand{
 			DataDir: expandHomePath(config.DataPath),
+			Timeout: timeouts.download,
+			DryRun:  dryRun,
 			Options: dlopt,
 		}
 
@@ -137,18 +361,40 @@ func main() {
 			SrcPath:        args[2],
 			DataDir:        expandHomePath(config.DataPath),
 			Download:       download,
+			Editor:         editor,
+			DryRun:         dryRun,
 			Options:        opt,
 		}
-		add.Exec(&collections)
+		if err := add.Exec(ctx, &collections); err != nil {
+			if ctx.Err() == nil {
+				printError("%v", err)
+			}
+			failed = true
+		}
+
+	case "edit":
+		opt := parseOptions(&args, EditOptions{}).(EditOptions)
+		values := parseOptions(&args, AddOptions{}).(AddOptions)
+		expectArgs(args, "edit", 2)
+		editor := expectProfile(config, values.Profile)
+
+		edit := EditCommand{
+			CollectionName: args[1],
+			Values:         values,
+			Editor:         editor,
+			Options:        opt,
+		}
+		edit.Exec(ctx, &collections)
 
 	case "desc":
 		opt := parseOptions(&args, DescOptions{}).(DescOptions)
 		expectArgs(args, "desc", 1)
+		editor := expectProfile(config, "")
 
 		desc := DescCommand{
 			Args:      args[1:],
 			Format:    config.VideoFormat,
-			Extension: config.Ffmpeg.FileFormat,
+			Extension: editor.FileFormat,
 			Options:   opt,
 		}
 		desc.Exec(&collections)
@@ -156,6 +402,7 @@ func main() {
 	case "schedule":
 		expectArgs(args, "schedule", 1)
 		opt := parseOptions(&args, ScheduleOptions{}).(ScheduleOptions)
+		expectProfile(config, opt.Profile)
 
 		var fn string
 		if len(args) > 1 {
@@ -165,13 +412,63 @@ func main() {
 		schedule := ScheduleCommand{
 			DataDir:         expandHomePath(config.DataPath),
 			Function:        fn,
-			Editor:          config.Ffmpeg,
+			Profile:         config.Profile,
 			Format:          config.VideoFormat,
 			UploadFrequency: config.UploadFrequency,
 			UploadTimeUTC:   config.UploadTimeUTC,
+			RenderTimeout:   timeouts.render,
+			Shorts:          config.Shorts,
+			Workers:         config.Workers,
+			DryRun:          dryRun,
 			Options:         opt,
 		}
-		schedule.Exec(&collections)
+		schedule.Exec(ctx, &collections)
+
+	case "mix":
+		opt := parseOptions(&args, MixOptions{}).(MixOptions)
+		expectArgs(args, "mix", 1)
+		expectProfile(config, opt.Profile)
+
+		mix := MixCommand{
+			DataDir: expandHomePath(config.DataPath),
+			Schedule: ScheduleCommand{
+				DataDir:         expandHomePath(config.DataPath),
+				Profile:         config.Profile,
+				RenderTimeout:   timeouts.render,
+				Format:          config.VideoFormat,
+				UploadFrequency: config.UploadFrequency,
+				UploadTimeUTC:   config.UploadTimeUTC,
+				Workers:         config.Workers,
+			},
+			Options: opt,
+		}
+		mix.Exec(ctx, &collections)
+
+	case "gc":
+		opt := parseOptions(&args, GcOptions{}).(GcOptions)
+		expectArgs(args, "gc", 1)
+
+		gc := GcCommand{
+			CacheDir: filepath.Join(expandHomePath(config.DataPath), "cache"),
+			Options:  opt,
+		}
+		gc.Exec(&collections)
+
+	case "render-worker":
+		opt := parseOptions(&args, WorkerOptions{}).(WorkerOptions)
+		expectArgs(args, "render-worker", 1)
+
+		worker := RenderWorkerCommand{
+			DataDir: expandHomePath(config.DataPath),
+			Schedule: ScheduleCommand{
+				Profile: config.Profile,
+				Shorts:  config.Shorts,
+			},
+			Config:  config.Worker,
+			Options: opt,
+		}
+		worker.Exec(ctx)
+		return
 
 	case "upload":
 		expectArgs(args, "upload", 1)
@@ -180,8 +477,20 @@ func main() {
 			ClientSecret: expandHomePath(config.ClientSecret),
 			RootPath:     expandHomePath(config.RootPath),
 			Metadata:     config.Metadata,
+			Timeout:      timeouts.upload,
+			DryRun:       dryRun,
 		}
-		upload.Exec(&collections)
+		upload.Exec(ctx, &collections)
+
+	case "loudness":
+		opt := parseOptions(&args, LoudnessOptions{}).(LoudnessOptions)
+		expectProfile(config, opt.Profile)
+
+		loudness := LoudnessCommand{
+			Profile: config.Profile,
+			Options: opt,
+		}
+		loudness.Exec(ctx, &collections)
 
 	case "status":
 		fmt.Println(collections.videoStatus())
@@ -200,8 +509,20 @@ func main() {
 		fmt.Println(help)
 		os.Exit(1)
 	}
+	if dryRun {
+		// Nothing is saved in a dry run
+		if ctx.Err() != nil || failed {
+			os.Exit(1)
+		}
+		return
+	}
 	os.MkdirAll(expandHomePath(config.RootPath), os.ModePerm)
+	// Collections are saved even when interrupted such that work that
+	// completed before the interrupt is not lost.
 	writeCollections(expandHomePath(config.CollectionsPath), &collections)
+	if ctx.Err() != nil || failed {
+		os.Exit(1)
+	}
 }
 
 func readCollections(path string) Collections {
@@ -269,6 +590,52 @@ func writeConfig(path string, config *Config) {
 	ioutil.WriteFile(path, file, os.ModePerm)
 }
 
+// Find a render profile by name, an empty name selects the default
+// profile. Fields left empty in a profile are taken from the Ffmpeg
+// editor which is also used when no default profile is configured, a
+// field is only empty when it is absent from the profile or set to its
+// zero value. Profiles without their own branding use the global
+// branding.
+func (self *Config) Profile(name string) (Editor, error) {
+	if name == "" {
+		name = self.DefaultProfile
+	}
+
+	editor := self.Ffmpeg
+	if name != "" {
+		var ok bool
+		editor, ok = self.Profiles[name]
+		if !ok {
+			return Editor{}, fmt.Errorf(Err_UnknownProfile, name)
+		}
+		inheritFields(&editor, self.Ffmpeg)
+	}
+
+	if editor.Branding == nil {
+		branding := self.Branding
+		editor.Branding = &branding
+	}
+	// Configs written before loudness normalization have no target,
+	// which is not a valid loudness.
+	if editor.Loudness.Target == 0 {
+		enabled := editor.Loudness.Enabled
+		editor.Loudness = defaultConfig.Ffmpeg.Loudness
+		editor.Loudness.Enabled = enabled
+	}
+	return editor, nil
+}
+
+// Set each field of dst that holds its zero value to the field of src
+func inheritFields(dst *Editor, src Editor) {
+	d := reflect.ValueOf(dst).Elem()
+	v := reflect.ValueOf(src)
+	for i := 0; i < d.NumField(); i++ {
+		if d.Field(i).IsZero() {
+			d.Field(i).Set(v.Field(i))
+		}
+	}
+}
+
 func parseOptions(args *[]string, val interface{}) interface{} {
 	positional := make([]string, 0, len(*args))
 	tags := make(map[string]string)
@@ -315,6 +682,16 @@ func parseOptions(args *[]string, val interface{}) interface{} {
 			}
 			f.SetInt(int64(n))
 			i += 1
+		case reflect.Float64:
+			if i+1 >= len(*args) {
+				userError(Err_MissingOption, a)
+			}
+			n, err := strconv.ParseFloat((*args)[i+1], 64)
+			if err != nil {
+				userError(Err_IncorrectOptType, "number", a)
+			}
+			f.SetFloat(n)
+			i += 1
 		default:
 			positional = append(positional, a)
 		}
@@ -323,6 +700,17 @@ func parseOptions(args *[]string, val interface{}) interface{} {
 	return s.Interface()
 }
 
+// Remove a flag from args, returns true if it was found
+func removeFlag(args *[]string, flag string) bool {
+	for i, a := range *args {
+		if a == flag {
+			*args = append((*args)[:i], (*args)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func expectArgs(args []string, name string, length int) {
 	if len(args) >= length {
 		return
@@ -330,6 +718,41 @@ func expectArgs(args []string, name string, length int) {
 	userError(Err_ExpectedArgs, length-1, name)
 }
 
+func expectProfile(config *Config, name string) Editor {
+	editor, err := config.Profile(name)
+	if err != nil {
+		userError(err.Error())
+	}
+	return editor
+}
+
+// Returns a context cancelled on the first interrupt signal, a second
+// interrupt exits immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		fmt.Println()
+		userLog("interrupt:", "Stopping, interrupt again to exit immediately.")
+		cancel()
+		<-sig
+		os.Exit(1)
+	}()
+	return ctx, cancel
+}
+
+// Derive a context with a timeout, a zero timeout only returns a
+// cancellable context.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func expandHomePath(path string) string {
 	usr, err := user.Current()
 	if err != nil {
@@ -360,6 +783,12 @@ func userProgress(stop chan bool, mod, format string, args ...interface{}) {
 }
 
 func userError(format string, args ...interface{}) {
+	printError(format, args...)
+	os.Exit(1)
+}
+
+// Print an error message without exiting
+func printError(format string, args ...interface{}) {
 	var pre string
 	if runtime.GOOS == "windows" {
 		pre = "error:"
@@ -368,7 +797,6 @@ func userError(format string, args ...interface{}) {
 	}
 	err := fmt.Sprintf(format, args...)
 	fmt.Printf("%s %s\n", pre, err)
-	os.Exit(1)
 }
 
 func userLog(mod, format string, args ...interface{}) {
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseOptions(t *testing.T) {
@@ -44,18 +58,21 @@ func TestBuildTemplate(t *testing.T) {
 		format   string
 		template Template
 		expect   string
+		fail     bool
 	}{
-		{"%(abc) - %(d)", Template{"abc": "ABC", "d": "D"}, "ABC - D"},
-		{"%%(abc)%%(d)%", Template{"abc": "ABC", "d": "D"}, "%ABC%D%"},
-		{"%(ab)c)", Template{"ab": "ABC"}, "ABCc)"},
-		{"%()", Template{"": "A"}, "A"},
+		{"%(abc) - %(d)", Template{"abc": "ABC", "d": "D"}, "ABC - D", false},
+		{"%%(abc)%%(d)%", Template{"abc": "ABC", "d": "D"}, "%ABC%D%", false},
+		{"%(ab)c)", Template{"ab": "ABC"}, "ABCc)", false},
+		{"%()", Template{"": "A"}, "A", false},
+		{"%(abc", Template{"abc": "ABC"}, "%(abc", true},
+		{"-i %(image) %(", Template{"image": "a.png"}, "-i %(image) %(", true},
 	}
 
 	for i, tt := range tests {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			s, err := buildTemplate(tt.format, tt.template)
-			if err != nil {
-				t.Error(err)
+			if (err != nil) != tt.fail {
+				t.Errorf("expected error %v, got %v", tt.fail, err)
 			}
 			if s != tt.expect {
 				t.Errorf("expected %s, got %s\n", tt.expect, s)
@@ -89,8 +106,8 @@ Artwork by ArtworkArtist
 			By:      "TrackArtist",
 			Artists: []string{"TrackArtist"},
 		},
-		Art: &Artwork{
-			Artist: "ArtworkArtist",
+		Art: []*Artwork{
+			{Artist: "ArtworkArtist"},
 		},
 		Format: &defaultConfig.VideoFormat,
 	}
@@ -115,6 +132,47 @@ Artwork by ArtworkArtist
 			t.Errorf("\nexpected\n'%s'\ngot\n'%s'", expect, s)
 		}
 	})
+
+	t.Run("OldConfig", func(t *testing.T) {
+		// Configs written before mixes have no mix title or chapters
+		format := defaultConfig.VideoFormat
+		format.MixTitle = ""
+		format.Chapter = ""
+		b := b
+		b.Format = &format
+		b.Tracks = []*Track{b.Track}
+		b.Chapters = []Chapter{{0, "Name", "TrackArtist"}}
+
+		s, err := b.Title()
+		if err != nil || s != "Name" {
+			t.Errorf("expected Name, got %s (%v)", s, err)
+		}
+		s, err = b.Desc(&c)
+		if err != nil || !strings.Contains(s, "0:00 TrackArtist - Name\n") {
+			t.Errorf("expected chapters, got\n%s (%v)", s, err)
+		}
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "autoyt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		b := b
+		b.DryRun = true
+		vid, err := b.Video(&c, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(vid.Path) != filepath.Join(dir, "schedule") {
+			t.Errorf("unexpected path %s", vid.Path)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "schedule")); !os.IsNotExist(err) {
+			t.Error("expected dry run not to create the schedule directory")
+		}
+	})
 }
 
 func TestAdd(t *testing.T) {
@@ -143,6 +201,26 @@ func TestAdd(t *testing.T) {
 			t.Errorf("did not insert %v", track.Artists[0])
 		}
 	})
+
+	t.Run("KnownArtist", func(t *testing.T) {
+		// Artists after one already in the collections are still added
+		track := Track{Path: "/track2", Artists: []string{"trackartist", "newartist"}}
+		AddTrack(&c, track)
+
+		if _, ok := c.Find(track.Artists[1]); !ok {
+			t.Errorf("did not insert %v", track.Artists[1])
+		}
+	})
+}
+
+func TestVideoStatus(t *testing.T) {
+	c := Collections{Schedule: []*Video{
+		{State: Scheduled}, {State: Published}, {State: Failed}, {State: Scheduled},
+	}}
+	expect := "scheduled: 2, published: 1, failed: 1"
+	if s := c.videoStatus(); s != expect {
+		t.Errorf("expected %s, got %s", expect, s)
+	}
 }
 
 func TestInferArtists(t *testing.T) {
@@ -203,3 +281,1260 @@ func TestCollectionsFind(t *testing.T) {
 		}
 	})
 }
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect []string
+	}{
+		{"", nil},
+		{"-r 1  -loop 1", []string{"-r", "1", "-loop", "1"}},
+		{`-vf "scale=1920:1080, fps=30"`, []string{"-vf", "scale=1920:1080, fps=30"}},
+		{`-metadata 'title=a "b"'`, []string{"-metadata", `title=a "b"`}},
+		{`a\ b "c\"d" e''`, []string{"a b", `c"d`, "e"}},
+		{`""`, []string{""}},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			args, err := splitArgs(tt.in)
+			if err != nil {
+				t.Error(err)
+			}
+			if strings.Join(args, "|") != strings.Join(tt.expect, "|") ||
+				len(args) != len(tt.expect) {
+				t.Errorf("expected %q, got %q", tt.expect, args)
+			}
+		})
+	}
+
+	if _, err := splitArgs(`-vf "scale`); err == nil {
+		t.Error("expected error for unterminated quote")
+	}
+}
+
+func TestEditorCommand(t *testing.T) {
+	video := Video{
+		Title: "A - B",
+		Path:  "/out/A - B.mp4",
+		Audio: "/music/a b.mp3",
+		Image: "/art/c.png",
+	}
+	// The frame rate of the default output args would drop the frames
+	// of the visualizer.
+	visualizer := defaultConfig.Ffmpeg
+	visualizer.Visualizer = Visualizer{Preset: "wave", Color: "red", Rate: 30}
+
+	tests := []struct {
+		editor Editor
+		expect string
+	}{
+		{
+			defaultConfig.Ffmpeg,
+			"-r 1 -loop 1 -i /art/c.png -i /music/a b.mp3 " +
+				"-c:a copy -r 1 -shortest -movflags +faststart /out/A - B.mp4",
+		},
+		{
+			Editor{InputArgs: "-loop 1", OutputArgs: "-acodec copy -shortest"},
+			"-loop 1 -i /art/c.png -i /music/a b.mp3 -c:a copy -shortest /out/A - B.mp4",
+		},
+		{
+			visualizer,
+			"-r 1 -loop 1 -i /art/c.png -i /music/a b.mp3 -filter_complex " +
+				"[1:a]showwaves=s=1920x216:mode=cline:colors=red:r=30,format=rgba[s1];" +
+				"[0:v]fps=30[s2];[s2][s1]overlay=(W-w)/2:H-h-0:shortest=1[s3] " +
+				"-map [s3] -map 1:a -c:a copy -shortest -movflags +faststart /out/A - B.mp4",
+		},
+		{
+			Editor{Args: `-i %(audio) -loop 1 -i %(image) -metadata "title=%(title)" %(output)`},
+			"-i /music/a b.mp3 -loop 1 -i /art/c.png -metadata title=A - B /out/A - B.mp4",
+		},
+		{
+			Editor{
+				InputArgs:  "-loop 1",
+				OutputArgs: "-shortest",
+				Canvas:     "1280x720",
+				Visualizer: Visualizer{Preset: "wave", Color: "red", Rate: 30},
+			},
+			"-loop 1 -i /art/c.png -i /music/a b.mp3 -filter_complex " +
+				"[1:a]showwaves=s=1280x144:mode=cline:colors=red:r=30,format=rgba[s1];" +
+				"[0:v]fps=30[s2];[s2][s1]overlay=(W-w)/2:H-h-0:shortest=1[s3] " +
+				"-map [s3] -map 1:a -c:a copy -shortest /out/A - B.mp4",
+		},
+		{
+			Editor{
+				InputArgs: "-loop 1",
+				Branding: &Branding{Watermark: Watermark{
+					Path:     "/logo.png",
+					Position: "top-left",
+					Opacity:  0.5,
+					Margin:   10,
+				}},
+			},
+			"-loop 1 -i /art/c.png -i /music/a b.mp3 -i /logo.png -filter_complex " +
+				"[2:v]format=rgba,colorchannelmixer=aa=0.5[s1];" +
+				"[0:v][s1]overlay=10:10[s2] -map [s2] -map 1:a -c:a copy /out/A - B.mp4",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			args, err := tt.editor.Command(&RenderJob{Video: &video, AudioCodec: "mp3"})
+			if err != nil {
+				t.Error(err)
+			}
+			if got := strings.Join(args, " "); got != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestAudioArgs(t *testing.T) {
+	tests := []struct {
+		editor   Editor
+		codec    string
+		filtered bool
+		expect   string
+	}{
+		{Editor{}, "aac", false, "-c:a copy"},
+		{Editor{}, "mp3", false, "-c:a copy"},
+		{Editor{}, "mp3", true, "-c:a aac -b:a 320k"},
+		{Editor{}, "flac", false, "-c:a aac -b:a 320k"},
+		{Editor{AudioBitrate: "256k"}, "", false, "-c:a aac -b:a 256k"},
+		{Editor{AudioCodec: "opus"}, "pcm_s16le", false, "-c:a libopus -b:a 192k"},
+		{Editor{AudioCodec: "vorbis"}, "flac", false, "error"},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			args, err := tt.editor.audioArgs(tt.codec, tt.filtered)
+			got := strings.Join(args, " ")
+			if err != nil {
+				got = "error"
+			}
+			if got != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestLoudness(t *testing.T) {
+	out := []byte(`[Parsed_loudnorm_0 @ 0x1] 
+{
+	"input_i" : "-21.30",
+	"input_tp" : "-4.05",
+	"input_lra" : "6.20",
+	"input_thresh" : "-31.58",
+	"output_i" : "-14.02",
+	"output_tp" : "-1.00",
+	"output_lra" : "5.10",
+	"output_thresh" : "-24.30",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.02"
+}
+`)
+	info, err := parseLoudnorm(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := LoudnessInfo{-21.3, -4.05, 6.2, -31.58, 0.02}
+	if *info != expect {
+		t.Errorf("expected %v, got %v", expect, *info)
+	}
+
+	target := defaultConfig.Ffmpeg.Loudness
+	if target.Contains(info) {
+		t.Errorf("expected %g LUFS outside target", info.Integrated)
+	}
+
+	target.Enabled = true
+	g := newFilterGraph("0:v", "1:a", 2)
+	target.apply(g, info)
+	viz := Visualizer{Preset: "wave", Color: "red", Rate: 30}
+	if err := viz.apply(g, "1280x720"); err != nil {
+		t.Fatal(err)
+	}
+	expectGraph := "[1:a]loudnorm=I=-14:TP=-1:LRA=11:measured_I=-21.3:measured_TP=-4.05:" +
+		"measured_LRA=6.2:measured_thresh=-31.58:offset=0.02:linear=true,aresample=48000[s1];" +
+		"[s1]asplit[s2][s3];" +
+		"[s3]showwaves=s=1280x144:mode=cline:colors=red:r=30,format=rgba[s4];" +
+		"[0:v]fps=30[s5];[s5][s4]overlay=(W-w)/2:H-h-0:shortest=1[s6]"
+	if g.String() != expectGraph {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expectGraph, g.String())
+	}
+	if g.audio != "s2" {
+		t.Errorf("expected audio stream s2, got %s", g.audio)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	out := []byte(`[silencedetect @ 0x1] silence_start: 0
+[silencedetect @ 0x1] silence_end: 2.5 | silence_duration: 2.5
+[silencedetect @ 0x1] silence_start: 60.2
+[silencedetect @ 0x1] silence_end: 61 | silence_duration: 0.8
+[silencedetect @ 0x1] silence_start: 178.4
+`)
+	trim := silenceTrim(parseSilence(out), 180)
+	if trim.Start != 2.5 || trim.End != 178.4 {
+		t.Errorf("expected trim 2.5 to 178.4, got %g to %g", trim.Start, trim.End)
+	}
+	if l := trim.Length(180); l != 175.9 {
+		t.Errorf("expected length 175.9, got %g", l)
+	}
+
+	trim.FadeIn, trim.FadeOut = 1, 4
+	g := newFilterGraph("0:v", "1:a", 2)
+	if err := trim.apply(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := trim.applyFades(g, 175.9); err != nil {
+		t.Fatal(err)
+	}
+	expect := "[1:a]atrim=start=2.5:end=178.4,asetpts=PTS-STARTPTS[s1];" +
+		"[s1]afade=t=in:st=0:d=1,afade=t=out:st=171.9:d=4[s2]"
+	if g.String() != expect {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expect, g.String())
+	}
+
+	if err := (&Trim{Start: 10, End: 5}).apply(g); err == nil {
+		t.Error("expected error for end before start")
+	}
+}
+
+func TestMix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cue := `PERFORMER "Various Artists"
+TITLE "Monthly Mix"
+FILE "mix.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    PERFORMER "A"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second feat. C"
+    PERFORMER "B"
+    INDEX 00 03:58:00
+    INDEX 01 04:00:37
+`
+	path := filepath.Join(dir, "mix.cue")
+	if err := ioutil.WriteFile(path, []byte(cue), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := ReadCueSheet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet.Title != "Monthly Mix" || sheet.File != filepath.Join(dir, "mix.flac") {
+		t.Errorf("unexpected sheet %+v", sheet)
+	}
+	if len(sheet.Tracks) != 2 || sheet.Tracks[1].Start != 240.49333333333334 {
+		t.Errorf("unexpected tracks %+v", sheet.Tracks)
+	}
+	if a := strings.Join(sheet.Artists(), ","); a != "A,B,C" {
+		t.Errorf("expected artists A,B,C, got %s", a)
+	}
+
+	tracks := []*Track{
+		{Title: "First", By: "A", Path: "/a.mp3", Duration: 200},
+		{Title: "Second", By: "B", Path: "/b.flac", Duration: 3500,
+			Trim: Trim{Start: 10, FadeIn: 2}},
+		{Title: "Third", By: "C", Path: "/c.mp3", Duration: 100},
+	}
+	chapters, duration, err := mixChapters(tracks, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []string
+	for _, ch := range chapters {
+		times = append(times, chapterTime(ch.Start))
+	}
+	if got := strings.Join(times, ","); got != "0:00,3:15,1:01:20" || duration != 3780 {
+		t.Errorf("expected 0:00,3:15,1:01:20 in 3780s, got %s in %gs", got, duration)
+	}
+
+	// YouTube ignores fewer than 3 chapters and chapters under 10s
+	if _, _, err := mixChapters(tracks[:2], 5); err == nil {
+		t.Error("expected error for 2 chapters")
+	}
+	short := []*Track{tracks[0], {Title: "Intro", Duration: 14}, tracks[2]}
+	if _, _, err := mixChapters(short, 5); err == nil {
+		t.Error("expected error for a 9s chapter")
+	}
+
+	// A pregap plays as part of the first chapter
+	pregap := &Track{Duration: 300, Chapters: []Chapter{
+		{Start: 2, Title: "First"}, {Start: 100, Title: "Second"}, {Start: 200, Title: "Third"}}}
+	if ch := trackChapters(pregap); ch[0].Start != 0 || ch[1].Start != 100 {
+		t.Errorf("expected chapters from 0:00, got %v", ch)
+	}
+	if err := checkChapters(pregap.Chapters, 300); err == nil {
+		t.Error("expected error for chapters starting after 0:00")
+	}
+
+	var segments []Segment
+	for _, tr := range tracks {
+		segments = append(segments, Segment{tr.Path, tr.Trim, tr.Duration})
+	}
+	g := newFilterGraph("0:v", "1:a", 2)
+	editor := Editor{}
+	if err := editor.applyMix(g, segments, 5); err != nil {
+		t.Fatal(err)
+	}
+	format := "aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo"
+	expect := "[1:a]" + format + "[s1];" +
+		"[2:a]atrim=start=10,asetpts=PTS-STARTPTS[s2];" +
+		"[s2]afade=t=in:st=0:d=2[s3];[s3]" + format + "[s4];" +
+		"[3:a]" + format + "[s5];" +
+		"[s1][s4]acrossfade=d=5[s6];[s6][s5]acrossfade=d=5[s7]"
+	if g.String() != expect {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expect, g.String())
+	}
+	if strings.Join(g.inputs, " ") != "-i /b.flac -i /c.mp3" {
+		t.Errorf("unexpected inputs %v", g.inputs)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	// Quiet, then a loud section in windows 4 to 6, then quiet again
+	var pcm bytes.Buffer
+	for w := 0; w < 10; w++ {
+		v := int16(100)
+		if w >= 4 && w <= 6 {
+			v = 16384
+		}
+		for i := 0; i < 4; i++ {
+			binary.Write(&pcm, binary.LittleEndian, v)
+			binary.Write(&pcm, binary.LittleEndian, -v)
+		}
+	}
+	pcm.WriteByte(0)
+
+	energy, err := readEnergy(&pcm, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(energy) != 10 || energy[5] != 0.5 {
+		t.Fatalf("unexpected energy %v", energy)
+	}
+
+	tests := []struct {
+		n      int
+		expect int
+	}{
+		{1, 4},
+		{3, 4},
+		{5, 2},
+		{10, 0},
+		{20, 0},
+	}
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if got := highlight(energy, tt.n); got != tt.expect {
+				t.Errorf("expected %d, got %d", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestVariant(t *testing.T) {
+	v := Variant{Name: "square", Canvas: "1080x1080", MaxDuration: 60, FadeOut: 2, VideoBitrate: "2M"}
+	track := &Track{Duration: 200, Trim: Trim{Start: 10, FadeIn: 1}}
+
+	trim := v.trim(track)
+	if trim != (Trim{Start: 10, End: 70, FadeIn: 1, FadeOut: 2}) {
+		t.Errorf("unexpected trim %v", trim)
+	}
+	track.Duration = 50
+	if trim := v.trim(track); trim != track.Trim {
+		t.Errorf("expected trim of short track to be kept, got %v", trim)
+	}
+
+	editor := v.editor(Editor{Canvas: "1920x1080", OutputArgs: "-r 1", Variants: []Variant{v}})
+	if editor.Canvas != "1080x1080" || editor.OutputArgs != "-r 1 -b:v 2M" || editor.Variants != nil {
+		t.Errorf("unexpected editor %v", editor)
+	}
+	if p := variantPath(&Video{Path: "/v/a.b.mp4"}, v.Name); p != "/v/a.b.square.mp4" {
+		t.Errorf("expected /v/a.b.square.mp4, got %s", p)
+	}
+}
+
+func TestTags(t *testing.T) {
+	format := defaultConfig.VideoFormat
+	format.Album = "%(by) Radio"
+	build := VideoBuilder{
+		Track:  &Track{Title: "T", By: "B", Artists: []string{"B", "C"}},
+		Format: &format,
+	}
+	tags, err := build.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishAt := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	job := RenderJob{
+		Video: &Video{Title: "B - T", Description: "desc", PublishAt: &publishAt},
+		Tags:  tags,
+	}
+	args := tagArgs("/v.mp4", "/v.tags.mp4", "/a.png", videoTags(&job))
+	expect := "-i /v.mp4 -i /a.png -map 0 -map 1:v -c copy -c:v:1 png -frames:v:1 1 " +
+		"-disposition:v:1 attached_pic -movflags +faststart -metadata album=B Radio " +
+		"-metadata album_artist=B -metadata artist=B -metadata comment=desc " +
+		"-metadata date=2020-05-01 -metadata description=desc " +
+		"-metadata title=B - T -y /v.tags.mp4"
+	if got := strings.Join(args, " "); got != expect {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expect, got)
+	}
+
+	build.Track.By = ""
+	format.Album = ""
+	tags, _ = build.Tags()
+	if tags["artist"] != "B, C" || tags["album"] != "" {
+		t.Errorf("expected artists of the track, got %v", tags)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	editor := Editor{Canvas: "1920x1080", Fit: "pad", Verify: &Verify{true, 2}}
+	streams := []StreamInfo{{CodecType: "video", Width: 1920, Height: 1080}, {CodecType: "audio"}}
+	tests := []struct {
+		info   MediaInfo
+		expect string
+	}{
+		{MediaInfo{streams, FormatInfo{Duration: "61.5"}}, ""},
+		{MediaInfo{streams, FormatInfo{Duration: "30"}}, "duration is 30.0s, expected 60.0s"},
+		{MediaInfo{streams[:1], FormatInfo{Duration: "60"}}, "no audio stream"},
+		{MediaInfo{streams[1:], FormatInfo{Duration: "60"}}, "no video stream"},
+		{MediaInfo{[]StreamInfo{{CodecType: "video", Width: 640, Height: 360}, {CodecType: "audio"}},
+			FormatInfo{Duration: "60"}}, "resolution is 640x360, expected 1920x1080"},
+	}
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if got := editor.verifyInfo(&tt.info, 60); got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+
+	atom := func(size int, name string) string {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, uint32(size))
+		b.WriteString(name)
+		b.Write(make([]byte, size-8))
+		return b.String()
+	}
+	atoms := []struct {
+		file   string
+		expect string
+	}{
+		{atom(16, "ftyp") + atom(8, "moov") + atom(12, "mdat"), "true"},
+		{atom(16, "ftyp") + atom(12, "mdat") + atom(8, "moov"), "false"},
+		{atom(16, "ftyp"), "error"},
+	}
+	for i, tt := range atoms {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			first, err := moovFirst(strings.NewReader(tt.file))
+			got := strconv.FormatBool(first)
+			if err != nil {
+				got = "error"
+			}
+			if got != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	audio := filepath.Join(dir, "a.mp3")
+	image := filepath.Join(dir, "a.png")
+	ioutil.WriteFile(audio, []byte("audio"), 0644)
+	ioutil.WriteFile(image, []byte("image"), 0644)
+
+	editor := defaultConfig.Ffmpeg
+	newJob := func(title string) *RenderJob {
+		return &RenderJob{
+			Video:      &Video{Title: title, Audio: audio, Image: image, Path: filepath.Join(dir, title+".mp4")},
+			AudioCodec: "mp3",
+			Cache:      RenderCache{Dir: filepath.Join(dir, "cache")},
+		}
+	}
+
+	// The title and output path of a video are not part of the key
+	key, err := editor.cacheKey(newJob("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := editor.cacheKey(newJob("b")); other != key {
+		t.Errorf("expected key %s, got %s", key, other)
+	}
+	ioutil.WriteFile(image, []byte("other image"), 0644)
+	if other, _ := editor.cacheKey(newJob("a")); other == key {
+		t.Error("expected key to change with the image")
+	}
+
+	job := newJob("a")
+	job.Cache.Key = key
+	ioutil.WriteFile(job.Video.Path, []byte("video"), 0644)
+	job.Cache.commit(job.Cache.keep(job.Video.Path))
+
+	dst := filepath.Join(dir, "b.mp4")
+	if !job.Cache.restore(dst) {
+		t.Fatal("expected cached render")
+	}
+	if b, _ := ioutil.ReadFile(dst); string(b) != "video" {
+		t.Errorf("expected cached video, got %q", b)
+	}
+	job.Cache.Key = "missing"
+	if job.Cache.restore(dst) {
+		t.Error("expected missing render not to be restored")
+	}
+}
+
+func TestRemoteWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	audio := filepath.Join(dir, "a.mp3")
+	image := filepath.Join(dir, "a.png")
+	ioutil.WriteFile(audio, []byte("audio"), 0644)
+	ioutil.WriteFile(image, []byte("image"), 0644)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		req, err := readWorkerRequest(r, dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job := req.Job
+		a, _ := ioutil.ReadFile(job.Video.Audio)
+		i, _ := ioutil.ReadFile(job.Slides[0].Image)
+		if job.Video.Audio == audio || string(a) != "audio" || string(i) != "image" {
+			http.Error(w, "inputs were not streamed", http.StatusInternalServerError)
+			return
+		}
+		if req.Profile.Name != "shorts" || !req.Profile.Short {
+			http.Error(w, "unexpected profile", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("video"))
+	}))
+	defer server.Close()
+
+	job := RenderJob{
+		Video:  &Video{Audio: audio, Image: image, Path: filepath.Join(dir, "out.mp4")},
+		Slides: []Slide{{Image: image}},
+	}
+	profile := RenderProfile{Name: "shorts", Short: true}
+	worker := RemoteWorker{URL: server.URL, Token: "secret"}
+	if err := worker.Render(context.Background(), profile, &job); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(job.Video.Path); string(b) != "video" {
+		t.Errorf("expected rendered video, got %q", b)
+	}
+
+	worker.Token = ""
+	err = worker.Render(context.Background(), profile, &job)
+	if _, ok := err.(*WorkerError); !ok {
+		t.Errorf("expected worker error, got %v", err)
+	}
+}
+
+func TestRenderWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared := filepath.Join(dir, "shared")
+	os.Mkdir(shared, os.ModePerm)
+	audio := filepath.Join(shared, "a.mp3")
+	ioutil.WriteFile(audio, []byte("audio"), 0644)
+
+	worker := RenderWorkerCommand{
+		DataDir:  dir,
+		Schedule: ScheduleCommand{Profile: defaultConfig.Profile},
+		Config: WorkerConfig{
+			Token:        "secret",
+			SharedRoots:  []string{shared},
+			MaxRequestMB: 1,
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(worker.serveRender))
+	defer server.Close()
+
+	big := filepath.Join(dir, "big.mp3")
+	ioutil.WriteFile(big, make([]byte, 2<<20), 0644)
+
+	cases := []struct {
+		remote  RemoteWorker
+		profile RenderProfile
+		audio   string
+		status  int
+	}{
+		{RemoteWorker{Token: "", Shared: true}, RenderProfile{}, audio, http.StatusUnauthorized},
+		{RemoteWorker{Token: "wrong", Shared: true}, RenderProfile{}, audio, http.StatusUnauthorized},
+		{RemoteWorker{Token: "secret", Shared: true}, RenderProfile{}, filepath.Join(dir, "a.mp3"), http.StatusForbidden},
+		{RemoteWorker{Token: "secret", Shared: true}, RenderProfile{}, filepath.Join(shared, "..", "a.mp3"), http.StatusForbidden},
+		{RemoteWorker{Token: "secret", Shared: true}, RenderProfile{}, "/etc/passwd", http.StatusForbidden},
+		{RemoteWorker{Token: "secret", Shared: true}, RenderProfile{Name: "unknown"}, audio, http.StatusBadRequest},
+		{RemoteWorker{Token: "secret", Shared: true}, RenderProfile{Variant: "unknown"}, audio, http.StatusBadRequest},
+		{RemoteWorker{Token: "secret"}, RenderProfile{}, big, http.StatusBadRequest},
+		// Accepted jobs fail to render without ffmpeg
+		{RemoteWorker{Token: "secret", Shared: true}, RenderProfile{}, audio, http.StatusInternalServerError},
+		{RemoteWorker{Token: "secret"}, RenderProfile{}, audio, http.StatusInternalServerError},
+	}
+
+	for i, c := range cases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			job := RenderJob{
+				Video:    &Video{Title: "A - T", Audio: c.audio, Path: filepath.Join(dir, "out.mp4")},
+				Duration: 60,
+			}
+			c.remote.URL = server.URL
+			err := c.remote.Render(context.Background(), c.profile, &job)
+			status := http.StatusOK
+			if err != nil {
+				status = http.StatusInternalServerError
+			}
+			if werr, ok := err.(*WorkerError); ok {
+				status, _ = strconv.Atoi(strings.Fields(werr.Reason)[0])
+			}
+			if status != c.status {
+				t.Errorf("expected status %d, got %v", c.status, err)
+			}
+		})
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	cases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"localhost:8090", true},
+		{"127.0.0.1:8090", true},
+		{"[::1]:8090", true},
+		{":8090", false},
+		{"0.0.0.0:8090", false},
+		{"192.168.1.2:8090", false},
+		{"8090", false},
+	}
+
+	for i, c := range cases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if got := isLoopback(c.addr); got != c.expected {
+				t.Errorf("%s: expected %v, got %v", c.addr, c.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetArtwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not an image"))
+	}))
+	defer server.Close()
+
+	download := DownloadCommand{DataDir: dir}
+	if _, err := download.GetArtwork(context.Background(), server.URL+"/art"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".cache", "art")); !os.IsNotExist(err) {
+		t.Error("expected failed download to be removed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := download.GetArtwork(ctx, server.URL+"/art.png"); err != context.Canceled {
+		t.Errorf("expected cancelled download, got %v", err)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	publishAt := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		format string
+		title  string
+		by     string
+		expect string
+	}{
+		{"%(video)", "Name", "A", "A - Name"},
+		{"%(video)", "a/b: c?", "A", "A - a_b_ c_"},
+		{"%(date)_%(by)_%(title)", "Name", "A", "2020-05-01_A_Name"},
+		{"%(month)/%(by)/%(title)", "x/y", "A.. ", "2020-05/A/x_y"},
+		{"%(title)", "con", "", "_con"},
+		{"%(title)", "...", "", "_"},
+		{"%(title)", strings.Repeat("é", 100), "", strings.Repeat("é", 90)},
+	}
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			format := defaultConfig.VideoFormat
+			format.FileName = tt.format
+			build := VideoBuilder{
+				Track:     &Track{Title: tt.title, By: tt.by},
+				Format:    &format,
+				PublishAt: &publishAt,
+			}
+			got, err := build.FileName()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+
+	t.Run("Unique", func(t *testing.T) {
+		c := Collections{Schedule: []*Video{{Path: "s/a.mp4"}}}
+		taken := make(map[string]bool)
+		for _, expect := range []string{"s/a (2).mp4", "s/a (3).mp4"} {
+			if got := uniqueVideoPath(&c, taken, "s/a", ".mp4"); got != expect {
+				t.Errorf("expected %s, got %s", expect, got)
+			}
+		}
+		if got := uniqueVideoPath(&c, taken, "s/b", ".mp4"); got != "s/b.mp4" {
+			t.Errorf("expected s/b.mp4, got %s", got)
+		}
+		// Titles differing only in case share a file on macOS and Windows
+		if got := uniqueVideoPath(&c, taken, "s/B", ".mp4"); got != "s/B (2).mp4" {
+			t.Errorf("expected s/B (2).mp4, got %s", got)
+		}
+		if got := uniqueVideoPath(&c, taken, "s/A", ".mp4"); got != "s/A (4).mp4" {
+			t.Errorf("expected s/A (4).mp4, got %s", got)
+		}
+	})
+}
+
+func TestFormatCommand(t *testing.T) {
+	args := []string{"-i", "/a b.mp3", "-filter_complex", "[0:v]fps=25[s1]", "", "it's"}
+	expect := `ffmpeg -i '/a b.mp3' -filter_complex '[0:v]fps=25[s1]' '' 'it'\''s'`
+	if got := formatCommand("ffmpeg", args); got != expect {
+		t.Errorf("expected %s, got %s", expect, got)
+	}
+	if s := ItemState(Scheduled).String(); s != "Scheduled" {
+		t.Errorf("expected Scheduled, got %s", s)
+	}
+}
+
+func TestConfigProfile(t *testing.T) {
+	config := defaultConfig
+	config.Profiles = map[string]Editor{
+		"mix":  {InputArgs: "-loop 1", FileFormat: ".mkv"},
+		"bare": {Metadata: &Metadata{}, Verify: &Verify{}},
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		e, err := config.Profile("")
+		if err != nil {
+			t.Error(err)
+		}
+		if e.InputArgs != config.Ffmpeg.InputArgs ||
+			!reflect.DeepEqual(*e.Branding, config.Branding) {
+			t.Errorf("expected %v, got %v", config.Ffmpeg, e)
+		}
+	})
+
+	t.Run("Named", func(t *testing.T) {
+		config.DefaultProfile = "mix"
+		e, err := config.Profile("")
+		if err != nil {
+			t.Error(err)
+		}
+		if e.Path != config.Ffmpeg.Path || e.FileFormat != ".mkv" {
+			t.Errorf("expected mix profile, got %v", e)
+		}
+		if e.InputArgs != "-loop 1" || e.OutputArgs != config.Ffmpeg.OutputArgs ||
+			e.Canvas != config.Ffmpeg.Canvas || e.Fit != config.Ffmpeg.Fit ||
+			e.AudioCodec != config.Ffmpeg.AudioCodec || e.FrameRate != config.Ffmpeg.FrameRate {
+			t.Errorf("expected empty fields of the Ffmpeg editor, got %v", e)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		e, err := config.Profile("bare")
+		if err != nil {
+			t.Error(err)
+		}
+		if e.Metadata.Enabled || e.Verify.Enabled {
+			t.Errorf("expected metadata and verify to stay disabled, got %v %v",
+				*e.Metadata, *e.Verify)
+		}
+		e, _ = config.Profile("mix")
+		if !e.Metadata.Enabled || !e.Verify.Enabled {
+			t.Error("expected metadata and verify of the Ffmpeg editor")
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		if _, err := config.Profile("gif"); err == nil {
+			t.Error("expected error for unknown profile")
+		}
+	})
+
+	t.Run("Loudness", func(t *testing.T) {
+		config.DefaultProfile = ""
+		config.Ffmpeg.Loudness = Loudness{Enabled: true}
+		e, err := config.Profile("")
+		if err != nil {
+			t.Error(err)
+		}
+		expect := defaultConfig.Ffmpeg.Loudness
+		expect.Enabled = true
+		if e.Loudness != expect {
+			t.Errorf("expected %v, got %v", expect, e.Loudness)
+		}
+	})
+}
+
+func TestReadProgress(t *testing.T) {
+	const out = `frame=10
+out_time_us=30000000
+speed=2.0x
+progress=continue
+out_time_us=60000000
+speed=3x
+progress=end
+`
+	var got []RenderStatus
+	readProgress(strings.NewReader(out), 120, func(s RenderStatus) {
+		got = append(got, s)
+	})
+
+	expect := []RenderStatus{
+		{Percent: 25, Speed: 2, ETA: 45 * time.Second},
+		{Percent: 100, Speed: 3, ETA: 0},
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d updates, got %d", len(expect), len(got))
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("expected %v, got %v", expect[i], got[i])
+		}
+	}
+}
+
+func TestFitArtwork(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	bg := color.RGBA{0, 0, 255, 255}
+
+	// Wide image, the left half is noise and the right half is flat
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			c := red
+			if x < 100 {
+				v := uint8((x*7919 + y*104729) % 251)
+				c = color.RGBA{v, v, v, 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+
+	t.Run("Pad", func(t *testing.T) {
+		frame := fitPad(src, 64, 64, bg)
+		if frame.Bounds().Dx() != 64 || frame.Bounds().Dy() != 64 {
+			t.Fatalf("expected 64x64 frame, got %v", frame.Bounds())
+		}
+		if frame.RGBAAt(0, 0) != bg {
+			t.Errorf("expected padding %v, got %v", bg, frame.RGBAAt(0, 0))
+		}
+		if frame.RGBAAt(60, 32) != red {
+			t.Errorf("expected artwork %v, got %v", red, frame.RGBAAt(60, 32))
+		}
+	})
+
+	t.Run("Crop", func(t *testing.T) {
+		scaled := resize(src, 128, 64)
+		r := entropyCrop(scaled, 64, 64)
+		if r.Min.X != 0 {
+			t.Errorf("expected crop of detailed half, got %v", r)
+		}
+	})
+
+	t.Run("Canvas", func(t *testing.T) {
+		w, h, err := parseCanvas("1081x1921")
+		if err != nil || w != 1080 || h != 1920 {
+			t.Errorf("expected 1080x1920, got %dx%d (%v)", w, h, err)
+		}
+		if _, _, err := parseCanvas("1920"); err == nil {
+			t.Error("expected error for invalid canvas")
+		}
+	})
+}
+
+func TestTextLayer(t *testing.T) {
+	layer := TextLayer{
+		Text:     "%(by) - %(title)",
+		Position: "bottom-left",
+		Margin:   40,
+		FadeIn:   1,
+		FadeOut:  2,
+	}
+	template := Template{"by": "A: B", "title": "[it's], 100%"}
+
+	g := newFilterGraph("0:v", "1:a", 2)
+	if err := layer.apply(g, template, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `[0:v]drawtext=expansion=none:` +
+		`text=A\\: B - \[it\\\'s\]\, 100%:fontsize=48:fontcolor=white:` +
+		`x=40:y=h-text_h-40:alpha=if(lt(t\,1)\,max((t-0)/1\,0)\,` +
+		`if(lt(t\,58)\,1\,max((60-t)/2\,0)))[s1]`
+	if g.String() != expect {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expect, g.String())
+	}
+}
+
+func TestSlideDurations(t *testing.T) {
+	tests := []struct {
+		slides []Slide
+		total  float64
+		expect string
+	}{
+		{[]Slide{{}, {}, {}}, 90, "30,30,30"},
+		{[]Slide{{Duration: 10}, {}, {}}, 90, "10,40,40"},
+		{[]Slide{{Duration: 10}, {Duration: 20}}, 90, "10,20"},
+		{[]Slide{{Duration: 100}, {}}, 90, "error"},
+		{[]Slide{{}, {}}, 0, "error"},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			d, err := slideDurations(tt.slides, tt.total)
+			got := "error"
+			if err == nil {
+				s := make([]string, len(d))
+				for i := range d {
+					s[i] = strconv.FormatFloat(d[i], 'g', -1, 64)
+				}
+				got = strings.Join(s, ",")
+			}
+			if got != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestMotion(t *testing.T) {
+	defaults := Motion{Speed: 1, MaxDuration: 600}
+	tests := []struct {
+		motion   Motion
+		duration float64
+		expect   string
+	}{
+		{Motion{}, 60, ""},
+		{Motion{Preset: MotionOff}, 60, ""},
+		{Motion{Preset: MotionZoomIn}, 700, ""},
+		{Motion{Preset: MotionZoomIn, Speed: 2, Focus: "0.25,0.75"}, 10,
+			"fps=25,scale=64:36,zoompan=z='1+0.3*min(on*2/250,1)':" +
+				"x='clip(iw*0.25-iw/zoom/2,0,iw-iw/zoom)':" +
+				"y='clip(ih*0.75-ih/zoom/2,0,ih-ih/zoom)':d=1:s=32x18:fps=25,setsar=1"},
+		{Motion{Preset: MotionPan}, 10,
+			"fps=25,scale=64:36,zoompan=z='1.2':" +
+				"x='(iw-iw/zoom)*min(on*1/250,1)':" +
+				"y='clip(ih*0.5-ih/zoom/2,0,ih-ih/zoom)':d=1:s=32x18:fps=25,setsar=1"},
+		{Motion{Preset: MotionZoomIn, Focus: "2,0"}, 10, "error"},
+		{Motion{Preset: "spin"}, 10, "error"},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m := tt.motion.Merge(defaults)
+			var got string
+			if m.enabled(tt.duration) {
+				var err error
+				got, err = m.filter(32, 18, 25, tt.duration)
+				if err != nil {
+					got = "error"
+				}
+			}
+			if got != tt.expect {
+				t.Errorf("\nexpected\n%s\ngot\n%s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestAnimatedArtwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+		},
+		Delay: []int{10, 0, 30},
+	}
+	path := filepath.Join(dir, "a.gif")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gif.EncodeAll(file, anim)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	editor := Editor{
+		LoopInputArgs:  "-stream_loop -1",
+		LoopOutputArgs: "-shortest",
+		Canvas:         "64x36",
+	}
+	frames, loop, err := editor.ProbeAnimation(path)
+	if err != nil || frames != 3 || loop != 0.5 {
+		t.Fatalf("expected 3 frames in 0.5s, got %d in %gs (%v)", frames, loop, err)
+	}
+
+	art := Artwork{Path: path, Frames: frames, LoopDuration: loop}
+	job := RenderJob{
+		Video:  &Video{Audio: "/a.mp3", Path: "/out.mp4"},
+		Slides: []Slide{{Image: path, Rate: art.FrameRate()}},
+	}
+	args, err := editor.Command(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "-stream_loop -1 -i " + path + " -i /a.mp3 -filter_complex " +
+		"[0:v]scale=64:36:force_original_aspect_ratio=decrease," +
+		"pad=64:36:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=6,format=yuv420p[s1] " +
+		"-map [s1] -map 1:a -c:a aac -b:a 320k -shortest /out.mp4"
+	if got := strings.Join(args, " "); got != expect {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expect, got)
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	tests := []struct {
+		head   string
+		expect string
+	}{
+		{"\x89PNG\r\n\x1a\n\x00\x00", "png"},
+		{"\xff\xd8\xff\xe0", "jpeg"},
+		{"GIF89a", "gif"},
+		{"RIFF\x24\x00\x00\x00WEBPVP8 ", "webp"},
+		{"\x00\x00\x00\x1cftypavif", "avif"},
+		{"II*\x00\x08\x00", "tiff"},
+		{"MM\x00*\x00\x00", "tiff"},
+		{"RIFF\x24\x00\x00\x00WAVE", ""},
+		{"", ""},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if got := imageFormat([]byte(tt.head)); got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestScheduleSets(t *testing.T) {
+	c := Collections{
+		Tracks: []*Track{
+			{Path: "/t1"},
+			{Path: "/t2"},
+		},
+		Artwork: []*Artwork{
+			{Path: "/a1", Set: "s"},
+			{Path: "/a2", Set: "s"},
+			{Path: "/a3"},
+		},
+		Indexes: make(map[string]Collection),
+	}
+
+	s, err := NewSchedule(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Count != 2 {
+		t.Fatalf("expected 2 videos, got %d", s.Count)
+	}
+	set := s.Artwork[1]
+	if len(set) != 2 || set[0].Path != "/a1" || set[1].Path != "/a2" {
+		t.Errorf("expected set [/a1 /a2], got %v", set)
+	}
+}
+
+func TestScheduleShortsAndVariants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Collections{Indexes: make(map[string]Collection)}
+	AddTrack(&c, Track{Path: "/t.mp3", Title: "T", By: "A", Artists: []string{"A"},
+		Duration: 30, Codec: "mp3"})
+	AddArtwork(&c, Artwork{Path: "/a.png", Artist: "B"})
+
+	editor := defaultConfig.Ffmpeg
+	editor.Variants = []Variant{{Name: "square", Canvas: "1080x1080"}}
+	schedule := ScheduleCommand{
+		DataDir:         dir,
+		Profile:         func(string) (Editor, error) { return editor, nil },
+		Format:          defaultConfig.VideoFormat,
+		UploadFrequency: 1,
+		UploadTimeUTC:   "12:00:00",
+		Shorts:          defaultConfig.Shorts,
+		Options:         ScheduleOptions{Shorts: true},
+	}
+	now := time.Now()
+	tasks := schedule.scheduleTasks(context.Background(), &c, now, now)
+	if len(tasks) != 3 || tasks[1].variant != "square" || !tasks[2].short {
+		t.Fatalf("expected video, variant and short, got %d tasks", len(tasks))
+	}
+
+	// The short is cut from the video, not from its variant
+	video, short := tasks[0].job.Video, tasks[2].job.Video
+	if short.ShortOf != video.UniqueId() {
+		t.Errorf("expected short of %s, got %s", video.UniqueId(), short.ShortOf)
+	}
+	if expect := filepath.Join(dir, "schedule", "A - T.short.mp4"); short.Path != expect {
+		t.Errorf("expected %s, got %s", expect, short.Path)
+	}
+	// Each task fits its own copy of the artwork
+	if tasks[1].art[0] == tasks[0].art[0] || tasks[2].art[0] == tasks[0].art[0] {
+		t.Error("expected artwork to be copied for the variant and short")
+	}
+
+	// Configs written before shorts have no short settings
+	schedule.Shorts = Shorts{}
+	schedule.Format.ShortTitle = ""
+	editor.Variants = nil
+	tasks = schedule.scheduleTasks(context.Background(), &c, now, now)
+	if len(tasks) != 2 {
+		t.Fatalf("expected video and short, got %d tasks", len(tasks))
+	}
+	short = tasks[1].job.Video
+	if short.Title != "A - T #shorts" || tasks[1].editor.Canvas != defaultConfig.Shorts.Canvas {
+		t.Errorf("expected default short settings, got %s at %s", short.Title, tasks[1].editor.Canvas)
+	}
+
+	// A short of a track of unknown duration keeps the configured length
+	schedule.Shorts = defaultConfig.Shorts
+	schedule.DryRun = true
+	c.Tracks[0].Duration = 0
+	schedule.Profile = func(string) (Editor, error) {
+		e := editor
+		e.ProbePath = "false"
+		return e, nil
+	}
+	tasks = schedule.scheduleTasks(context.Background(), &c, now, now)
+	if d := tasks[1].job.Duration; d != defaultConfig.Shorts.Duration {
+		t.Errorf("expected a %gs short, got %gs", defaultConfig.Shorts.Duration, d)
+	}
+}
+
+func TestRenderAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoyt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Stands in for ffmpeg, the first video finishes last and the
+	// second fails.
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	ioutil.WriteFile(ffmpeg, []byte(`#!/bin/sh
+for arg; do out=$arg; done
+case "$out" in *T1*) sleep 0.5;; *T2*) exit 1;; esac
+echo video > "$out"
+`), 0755)
+
+	cases := []struct {
+		jobs   int
+		titles []string
+	}{
+		{1, []string{"T1", "T3"}},
+		{3, []string{"T1", "T3"}},
+	}
+
+	for i, tt := range cases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c := Collections{Indexes: make(map[string]Collection)}
+			for j := 1; j <= 3; j++ {
+				audio := filepath.Join(dir, fmt.Sprintf("t%d.mp3", j))
+				image := filepath.Join(dir, fmt.Sprintf("a%d.png", j))
+				ioutil.WriteFile(audio, []byte(audio), 0644)
+				ioutil.WriteFile(image, []byte(image), 0644)
+				AddTrack(&c, Track{Path: audio, Title: fmt.Sprintf("T%d", j), By: "A",
+					Artists: []string{"A"}, Duration: 30, Codec: "mp3"})
+				AddArtwork(&c, Artwork{Path: image, Artist: "B"})
+			}
+
+			editor := Editor{Path: ffmpeg, ProbePath: "false", FileFormat: ".mp4"}
+			schedule := ScheduleCommand{
+				DataDir:         filepath.Join(dir, strconv.Itoa(i)),
+				Profile:         func(string) (Editor, error) { return editor, nil },
+				Format:          defaultConfig.VideoFormat,
+				UploadFrequency: 1,
+				UploadTimeUTC:   "12:00:00",
+				Options:         ScheduleOptions{Jobs: tt.jobs},
+			}
+			if n := schedule.renderAll(context.Background(), &c); n != len(tt.titles) {
+				t.Fatalf("expected %d videos, got %d", len(tt.titles), n)
+			}
+
+			// Slots follow the order of the tracks, the slot of the
+			// failed video goes to the next one.
+			for j, title := range tt.titles {
+				vid := c.Schedule[j]
+				if !strings.Contains(vid.Title, title) {
+					t.Errorf("expected %s in slot %d, got %s", title, j+1, vid.Title)
+				}
+				expect := c.Schedule[0].PublishAt.AddDate(0, 0, j)
+				if !vid.PublishAt.Equal(expect) {
+					t.Errorf("expected %s at %v, got %v", title, expect, vid.PublishAt)
+				}
+			}
+			for _, track := range c.Tracks {
+				var expect ItemState = Scheduled
+				if track.Title == "T2" {
+					expect = Buffered
+				}
+				if track.State != expect {
+					t.Errorf("expected %s %v, got %v", track.Title, expect, track.State)
+				}
+			}
+		})
+	}
+}
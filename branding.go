@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Branding added to every video, configured globally and overridden
+// per render profile. Intro and Outro are video files joined before and
+// after the rendered video with a Crossfade in seconds.
+type Branding struct {
+	Watermark Watermark
+	Intro     string
+	Outro     string
+	Crossfade float64
+	// Frame rate and output arguments used when joining intro and outro
+	// clips, the rendered video is encoded again in this pass.
+	FrameRate  int
+	OutputArgs string
+}
+
+// Logo overlaid on the video. Scale is the width of the logo relative
+// to the canvas width, zero keeps the size of the image.
+type Watermark struct {
+	Path     string
+	Position string
+	Opacity  float64
+	Scale    float64
+	Margin   int
+}
+
+func (self *Branding) hasBumpers() bool {
+	return self != nil && (self.Intro != "" || self.Outro != "")
+}
+
+func (self *Watermark) apply(g *filterGraph, canvas string) error {
+	if self.Path == "" {
+		return nil
+	}
+
+	logo := inputStream(g.Input("-i", expandHomePath(self.Path)), "v")
+	chain := []string{"format=rgba"}
+
+	if self.Scale > 0 {
+		if canvas == "" {
+			return fmt.Errorf(Err_CanvasRequired, "a scaled watermark")
+		}
+		cw, _, err := parseCanvas(canvas)
+		if err != nil {
+			return err
+		}
+		w := int(float64(cw)*self.Scale) &^ 1
+		chain = append(chain, fmt.Sprintf("scale=%d:-1", w))
+	}
+	if self.Opacity > 0 && self.Opacity < 1 {
+		chain = append(chain, fmt.Sprintf("colorchannelmixer=aa=%g", self.Opacity))
+	}
+
+	logo = g.Add(strings.Join(chain, ","), logo)
+	pos := overlayPosition(self.Position, self.Margin)
+	g.video = g.Add("overlay="+pos, g.video, logo)
+	return nil
+}
+
+// Join intro and outro clips around the video rendered to src, writing
+// the result to dst. Clips are scaled to the canvas and their audio is
+// resampled so clips from different sources can be joined.
+func (self *Editor) addBumpers(ctx context.Context, job *RenderJob, src, dst string) error {
+	b := self.Branding
+	if self.Canvas == "" {
+		return fmt.Errorf(Err_CanvasRequired, "intro and outro clips")
+	}
+	w, h, err := parseCanvas(self.Canvas)
+	if err != nil {
+		return err
+	}
+
+	rate := b.FrameRate
+	if rate <= 0 {
+		rate = 25
+	}
+
+	var clips []string
+	if b.Intro != "" {
+		clips = append(clips, expandHomePath(b.Intro))
+	}
+	clips = append(clips, src)
+	if b.Outro != "" {
+		clips = append(clips, expandHomePath(b.Outro))
+	}
+
+	var videos, audios []string
+	var durations []float64
+	g := newFilterGraph("", "", 0)
+	total := 0.0
+
+	for _, clip := range clips {
+		info, err := self.Probe(clip)
+		if err != nil {
+			return err
+		}
+		d := info.Duration()
+		durations = append(durations, d)
+		total += d
+		input := g.Input("-i", clip)
+
+		v := g.Add(canvasFilter(w, h, float64(rate)), inputStream(input, "v"))
+
+		// Clips without audio get silence so every clip can be joined
+		a := inputStream(input, "a")
+		if _, ok := info.Stream("audio"); !ok {
+			a = g.Add(fmt.Sprintf("anullsrc=r=48000:cl=stereo,atrim=duration=%g", d))
+		}
+		a = g.Add("aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo", a)
+
+		videos = append(videos, v)
+		audios = append(audios, a)
+	}
+
+	if b.Crossfade > 0 {
+		fade := b.Crossfade
+		g.video, g.audio = videos[0], audios[0]
+		offset := 0.0
+		for i := 1; i < len(clips); i++ {
+			offset += durations[i-1] - fade
+			g.video = g.Add(fmt.Sprintf(
+				"xfade=transition=fade:duration=%g:offset=%g", fade, offset),
+				g.video, videos[i])
+			g.audio = g.Add(fmt.Sprintf("acrossfade=d=%g", fade), g.audio, audios[i])
+			total -= fade
+		}
+	} else {
+		var inputs []string
+		for i := range clips {
+			inputs = append(inputs, videos[i], audios[i])
+		}
+		out := g.AddN(fmt.Sprintf("concat=n=%d:v=1:a=1", len(clips)), 2, inputs...)
+		g.video, g.audio = out[0], out[1]
+	}
+
+	outArgs := b.OutputArgs
+	if outArgs == "" {
+		outArgs = "-c:v libx264 -pix_fmt yuv420p -c:a aac -b:a 320k -movflags +faststart"
+	}
+	words, err := splitArgs(outArgs)
+	if err != nil {
+		return err
+	}
+
+	args := append(g.inputs, "-filter_complex", g.String(),
+		"-map", mapStream(g.video), "-map", mapStream(g.audio))
+	args = append(args, words...)
+	args = append(args, "-y", dst)
+
+	var logPath string
+	if job.LogPath != "" {
+		logPath = strings.TrimSuffix(job.LogPath, ".log") + ".bumpers.log"
+	}
+	return runFfmpeg(ctx, self.Path, args, total, logPath, job.Progress)
+}
+
+// Seconds the intro and outro clips add to a video, less the crossfades
+// joining them.
+func (self *Editor) bumperDuration() (float64, error) {
+	b := self.Branding
+	total := 0.0
+	for _, clip := range []string{b.Intro, b.Outro} {
+		if clip == "" {
+			continue
+		}
+		info, err := self.Probe(expandHomePath(clip))
+		if err != nil {
+			return 0, err
+		}
+		total += info.Duration()
+		if b.Crossfade > 0 {
+			total -= b.Crossfade
+		}
+	}
+	return total, nil
+}
+
+// Path the video is rendered to before intro and outro clips are added
+func bumperTempPath(output string) string {
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + ".main" + ext
+}
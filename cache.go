@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Rendered videos are cached in Dir by a hash of their inputs and
+// ffmpeg arguments, such that rendering the same video again reuses the
+// cached file. Force renders the video even when it is cached. Key is
+// set when the video is rendered.
+type RenderCache struct {
+	Dir   string
+	Force bool
+	Key   string
+}
+
+type GcOptions struct {
+	Age string `opt:"-age"`
+}
+
+// Remove cached renders that are not used by a scheduled video and
+// were not used within Options.Age.
+type GcCommand struct {
+	CacheDir string
+	Options  GcOptions
+}
+
+// Unused cache entries are kept for a week by default
+const defaultCacheAge = 7 * 24 * time.Hour
+
+func (self *GcCommand) Exec(c *Collections) {
+	age := defaultCacheAge
+	if self.Options.Age != "" {
+		var err error
+		if age, err = time.ParseDuration(self.Options.Age); err != nil {
+			userError(Err_InvalidTimeout, self.Options.Age)
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, v := range c.Schedule {
+		if v.State == Published {
+			continue
+		}
+		used[v.RenderKey] = true
+		for _, variant := range v.Variants {
+			used[variant.RenderKey] = true
+		}
+	}
+
+	entries, err := ioutil.ReadDir(self.CacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		userError(err.Error())
+	}
+	count := 0
+	var size int64
+	for _, e := range entries {
+		key := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		if used[key] || time.Since(e.ModTime()) < age {
+			continue
+		}
+		if err := os.Remove(filepath.Join(self.CacheDir, e.Name())); err != nil {
+			printError("gc: %v", err)
+			continue
+		}
+		count++
+		size += e.Size()
+	}
+	userLog("gc:", "removed %d cached videos (%.1f MB)", count, float64(size)/1e6)
+}
+
+// Hash of the files and ffmpeg arguments a video is rendered from
+func (self *Editor) cacheKey(job *RenderJob) (string, error) {
+	h := sha256.New()
+
+	// Arguments are hashed with a fixed output path
+	keyJob := *job
+	keyJob.Output = "output"
+	args, err := self.Command(&keyJob)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "%q\n", args)
+	if self.Branding.hasBumpers() {
+		branding, _ := json.Marshal(self.Branding)
+		h.Write(branding)
+	}
+
+	files := []string{job.Video.Audio}
+	for _, s := range job.Segments {
+		files = append(files, s.Path)
+	}
+	for _, s := range job.Slides {
+		files = append(files, s.Image)
+	}
+	if len(job.Slides) == 0 {
+		files = append(files, job.Video.Image)
+	}
+	for _, path := range files {
+		if err := hashFile(h, path); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(h, file)
+	return err
+}
+
+func (self *RenderCache) path(ext string) string {
+	return filepath.Join(self.Dir, self.Key+ext)
+}
+
+// Link the cached render to dst, returns false if it is not cached
+func (self *RenderCache) restore(dst string) bool {
+	src := self.path(filepath.Ext(dst))
+	if !fileExists(src) {
+		return false
+	}
+	if err := linkFile(src, dst); err != nil {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(src, now, now)
+	return true
+}
+
+// Keep a link to a render which is added to the cache by commit once
+// the render is complete, returns an empty path on failure.
+func (self *RenderCache) keep(path string) string {
+	os.MkdirAll(self.Dir, os.ModePerm)
+	part := self.path(".part" + filepath.Ext(path))
+	if err := linkFile(path, part); err != nil {
+		return ""
+	}
+	return part
+}
+
+func (self *RenderCache) commit(part string) {
+	ext := filepath.Ext(part)
+	os.Rename(part, self.path(ext))
+}
+
+// Hard link src to dst, or copy it when linking is not possible
+func linkFile(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -12,10 +12,21 @@ const (
 	Scheduled
 	Published
 	Removed
+	// Rendered but failed verification, see Video.Error
+	Failed
 )
 
 type ItemState int
 
+var stateNames = [...]string{"Buffered", "Scheduled", "Published", "Removed", "Failed"}
+
+func (self ItemState) String() string {
+	if self < 0 || int(self) >= len(stateNames) {
+		return fmt.Sprintf("ItemState(%d)", int(self))
+	}
+	return stateNames[self]
+}
+
 type Collection interface {
 	UniqueId() string
 }
@@ -29,6 +40,19 @@ type Video struct {
 	UploadId    *string
 	Audio       string
 	Image       string
+	// All images of a slideshow in order, empty for a single image
+	Images []string
+	// All tracks of a mix in order, empty for a single track
+	Tracks  []string
+	Profile string
+	// Id of the video a short was cut from
+	ShortOf string
+	// Extra outputs rendered from the same track and artwork
+	Variants []VideoVariant
+	// Reason a failed video did not pass verification
+	Error string
+	// Key of the render in the render cache
+	RenderKey string
 }
 
 type Track struct {
@@ -38,12 +62,41 @@ type Track struct {
 	Description string
 	Path        string
 	State       ItemState
+	Profile     string
+	// Duration and codec of the audio file, zero until probed
+	Duration float64
+	Codec    string
+	// Part of the audio used in videos
+	Trim Trim
+	// Chapters of a track read from a cue sheet
+	Chapters []Chapter
+	// Measured by the loudness command or the first render with
+	// loudness normalization enabled
+	Loudness *LoudnessInfo
+	// Visualizer preset overriding the render profile
+	Visualizer string
 }
 
 type Artwork struct {
-	Artist string
-	Path   string
-	State  ItemState
+	Artist  string
+	Path    string
+	State   ItemState
+	Profile string
+	// File the artwork was added from when it was converted to the png
+	// at Path, see Editor.ConvertArtwork
+	Original string
+	// Artwork fitted to the render canvas, see Editor.PrepareArtwork
+	Frame string
+	// Artwork added to the same set is shown as a slideshow in a single
+	// video, each image for Duration seconds or an even split if zero.
+	Set      string
+	Duration float64
+	// Zoom or pan over the artwork, overriding the render profile
+	Motion Motion
+	// Number of frames and seconds per loop of animated artwork such
+	// as gifs and short video loops, zero for still images.
+	Frames       int
+	LoopDuration float64
 }
 
 type Artist struct {
@@ -103,16 +156,17 @@ func sortVideos(videos []*Video) {
 }
 
 func (self *Collections) videoStatus() string {
-	var sum [4]int
+	var sum [len(stateNames)]int
 	for _, v := range self.Schedule {
-		if int(v.State) > len(sum) {
+		if int(v.State) >= len(sum) {
 			panic(v)
 		}
 		sum[v.State]++
 	}
 	s := sum[Scheduled]
 	p := sum[Published]
-	return fmt.Sprintf("scheduled: %d, published: %d", s, p)
+	f := sum[Failed]
+	return fmt.Sprintf("scheduled: %d, published: %d, failed: %d", s, p, f)
 }
 
 func (self *Track) UniqueId() string {
@@ -123,6 +177,14 @@ func (self *Artwork) UniqueId() string {
 	return self.Path
 }
 
+// Frame rate of animated artwork, zero for still images
+func (self *Artwork) FrameRate() float64 {
+	if self.Frames < 2 || self.LoopDuration <= 0 {
+		return 0
+	}
+	return float64(self.Frames) / self.LoopDuration
+}
+
 func (self *Artist) UniqueId() string {
 	return strings.ToLower(self.Name)
 }
@@ -131,12 +193,31 @@ func (self *Video) UniqueId() string {
 	return self.Path
 }
 
+// Ids of the artwork shown in the video
+func (self *Video) ImageIds() []string {
+	if len(self.Images) > 0 {
+		return self.Images
+	}
+	return []string{self.Image}
+}
+
+// Ids of the tracks played in the video
+func (self *Video) AudioIds() []string {
+	if len(self.Tracks) > 0 {
+		return self.Tracks
+	}
+	return []string{self.Audio}
+}
+
 func (self *Video) String() string {
 	if self.PublishAt == nil {
 		return self.Title
 	}
 	timeStamp := self.PublishAt.Format("2006-01-02 15:04")
 	str := fmt.Sprintf("%s @(%s)", self.Title, timeStamp)
+	if self.State == Failed {
+		return fmt.Sprintf("%s (failed: %s)", str, self.Error)
+	}
 	if self.UploadId == nil {
 		return str
 	}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	Err_CueParse = "Failed to parse cue sheet '%s' line %d (%s)."
+	Err_CueFiles = "Cue sheet '%s' must reference exactly one audio file."
+)
+
+// A cue sheet describing the tracks of a single audio file
+type CueSheet struct {
+	Title     string
+	Performer string
+	File      string
+	Tracks    []Chapter
+}
+
+// Read a cue sheet, the audio file path is resolved relative to the
+// directory of the sheet.
+func ReadCueSheet(path string) (*CueSheet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sheet := new(CueSheet)
+	var track *Chapter
+	files := 0
+	n := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+		words, err := splitArgs(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf(Err_CueParse, path, n, err)
+		}
+		if len(words) < 2 {
+			continue
+		}
+
+		switch strings.ToUpper(words[0]) {
+		case "FILE":
+			files++
+			sheet.File = words[1]
+			if !filepath.IsAbs(sheet.File) {
+				sheet.File = filepath.Join(filepath.Dir(path), sheet.File)
+			}
+		case "TRACK":
+			sheet.Tracks = append(sheet.Tracks, Chapter{})
+			track = &sheet.Tracks[len(sheet.Tracks)-1]
+		case "TITLE":
+			if track == nil {
+				sheet.Title = words[1]
+			} else {
+				track.Title = words[1]
+			}
+		case "PERFORMER":
+			if track == nil {
+				sheet.Performer = words[1]
+			} else {
+				track.By = words[1]
+			}
+		case "INDEX":
+			// Index 01 is the start of the track, 00 is the pregap
+			if track == nil || len(words) < 3 || words[1] != "01" {
+				continue
+			}
+			start, err := parseCueTime(words[2])
+			if err != nil {
+				return nil, fmt.Errorf(Err_CueParse, path, n, err)
+			}
+			track.Start = start
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if files != 1 {
+		return nil, fmt.Errorf(Err_CueFiles, path)
+	}
+	for i := range sheet.Tracks {
+		if sheet.Tracks[i].By == "" {
+			sheet.Tracks[i].By = sheet.Performer
+		}
+	}
+	return sheet, nil
+}
+
+// Parse a cue time in minutes, seconds and frames (mm:ss:ff), there are
+// 75 frames per second.
+func parseCueTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time '%s'", s)
+		}
+		v[i] = n
+	}
+	return float64(v[0]*60+v[1]) + float64(v[2])/75, nil
+}
+
+// Artists of every track in the sheet
+func (self *CueSheet) Artists() []string {
+	var artists []string
+	for _, t := range self.Tracks {
+		for _, a := range inferArtists(t.Title, t.By, AddOptions{}) {
+			if a != "" {
+				appendUnique(&artists, a)
+			}
+		}
+	}
+	return artists
+}
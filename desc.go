@@ -58,7 +58,13 @@ func (self *DescCommand) Exec(c *Collections) {
 
 		// Build video but don't render it, we just want a preview of
 		// what the final video information will look like.
-		build := VideoBuilder{track, art, &self.Format, self.Extension}
+		build := VideoBuilder{
+			Track:     track,
+			Art:       art,
+			Format:    &self.Format,
+			Extension: self.Extension,
+			Chapters:  trackChapters(track),
+		}
 		vid, err := build.Video(c, "")
 
 		if err != nil {
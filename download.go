@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 const (
@@ -20,49 +24,107 @@ type DownloadOptions struct {
 
 type DownloadCommand struct {
 	DataDir string
+	Timeout time.Duration
+	// Print the path artwork would be downloaded to without downloading
+	DryRun  bool
 	Options DownloadOptions
 }
 
-func (self *DownloadCommand) GetArtwork(urlPath string) string {
+// Download artwork from a url to the data cache directory. The partially
+// downloaded file is removed if the download fails or ctx is cancelled,
+// in which case the error of ctx is returned.
+func (self *DownloadCommand) GetArtwork(ctx context.Context, urlPath string) (string, error) {
 	dst := path.Join(self.DataDir, ".cache")
+	if self.DryRun {
+		return self.planDownload(urlPath, dst)
+	}
 	os.MkdirAll(dst, os.ModePerm)
 
+	ctx, cancel := withTimeout(ctx, self.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", urlPath, nil)
+	if err != nil {
+		return "", fmt.Errorf(Err_DownloadFailed, urlPath, err)
+	}
+
 	stop := make(chan bool)
 	go userProgress(stop, "download:", urlPath)
 
-	res, err := http.Get(urlPath)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
 	stop <- true
 	userLogRepl("download:", "%s  \n", urlPath)
 
 	if err != nil {
-		userError(Err_DownloadFailed, urlPath, err)
+		return "", downloadError(ctx, urlPath, err)
 	}
 	defer res.Body.Close()
 
 	urlParts := strings.Split(urlPath, "/")
 	dst = path.Join(dst, urlParts[len(urlParts)-1])
 
+	// Without a known extension the format is detected from the
+	// downloaded content.
+	sniff := false
 	if self.Options.FileExtension != "" {
 		dst += self.Options.FileExtension
 	} else if !validFileName(dst) {
-		userError(Err_UnknownExtension)
+		sniff = true
 	}
 
 	file, err := os.Create(dst)
 	if err != nil {
-		userError(Err_DownloadFailed, urlPath, err)
+		return "", fmt.Errorf(Err_DownloadFailed, urlPath, err)
 	}
-	defer file.Close()
 
 	_, err = io.Copy(file, res.Body)
+	file.Close()
 	if err != nil {
-		userError(Err_DownloadFailed, urlPath, err)
+		os.Remove(dst)
+		return "", downloadError(ctx, urlPath, err)
+	}
+
+	if sniff {
+		format, _ := sniffImage(dst)
+		ext, ok := imageExtensions[format]
+		if !ok {
+			os.Remove(dst)
+			return "", errors.New(Err_UnknownExtension)
+		}
+		if err := os.Rename(dst, dst+ext); err != nil {
+			os.Remove(dst)
+			return "", fmt.Errorf(Err_DownloadFailed, urlPath, err)
+		}
+		dst += ext
 	}
-	return dst
+	return dst, nil
+}
+
+// Error of a failed download, or the error of ctx when it was cancelled
+func downloadError(ctx context.Context, urlPath string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf(Err_DownloadFailed, urlPath, err)
+}
+
+// Print the path artwork would be downloaded to, the extension of files
+// named without one is only known once they are downloaded.
+func (self *DownloadCommand) planDownload(urlPath, dst string) (string, error) {
+	if _, err := http.NewRequest("GET", urlPath, nil); err != nil {
+		return "", fmt.Errorf(Err_DownloadFailed, urlPath, err)
+	}
+	urlParts := strings.Split(urlPath, "/")
+	dst = path.Join(dst, urlParts[len(urlParts)-1]+self.Options.FileExtension)
+	userLog("download:", "%s -> %s", urlPath, dst)
+	return dst, nil
 }
 
 func validFileName(name string) bool {
-	exts := [...]string{".png", ".jpg", ".jpeg", ".gif", ".bmp"}
+	exts := [...]string{
+		".png", ".jpg", ".jpeg", ".gif", ".bmp", ".webp", ".avif", ".tif",
+		".tiff", ".mp4", ".webm",
+	}
 	for _, ext := range exts {
 		if strings.HasSuffix(name, ext) {
 			return true
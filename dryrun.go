@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	Err_DryRun            = "Dry run found %d problems."
+	Err_DryRunUnsupported = "--dry-run is not supported by %s."
+)
+
+// Remove a file, or only print its path in a dry run
+func removeFile(path string, dryRun bool) {
+	if dryRun {
+		userLog("remove:", path)
+		return
+	}
+	os.Remove(path)
+}
+
+// Print a change of state of an item in the collections
+func logState(name string, from, to ItemState) {
+	userLog("state:", "%s: %s -> %s", name, from, to)
+}
+
+// Format a command line such that it can be pasted into a shell
+func formatCommand(path string, args []string) string {
+	return quoteArgs(append([]string{path}, args...))
+}
+
+// Print the ffmpeg commands of each task and the state changes rendering
+// them would make, returns the number of tasks that would fail. Slides
+// are the artwork as added, without fitting it to the canvas. Commands
+// depending on the output of an earlier command are left out: the
+// render is not normalized with the measured loudness, intro and outro
+// clips are not joined, and shorts start at 0 rather than at the
+// highlight of the track, which is found by decoding its audio.
+func (self *ScheduleCommand) planRender(tasks []renderTask) int {
+	failed := 0
+	for i := range tasks {
+		task := &tasks[i]
+		job := &task.job
+		job.Slides = make([]Slide, len(task.art))
+		for i, art := range task.art {
+			job.Slides[i] = Slide{
+				Image:    art.Path,
+				Duration: art.Duration,
+				Motion:   art.Motion,
+				Rate:     art.FrameRate(),
+			}
+		}
+
+		editor := &task.editor
+		dst := job.Video.Path
+		userLog("render:", "%s -> %s", job.Video.Title, dst)
+		if editor.Loudness.Enabled && job.Loudness == nil && len(job.Segments) == 0 {
+			args := editor.loudnessArgs(job.Video.Audio, job.Trim)
+			fmt.Println(formatCommand(editor.Path, args))
+		}
+		if editor.Branding.hasBumpers() {
+			job.Output = bumperTempPath(dst)
+		}
+		args, err := editor.Command(job)
+		if err != nil {
+			printError("render: %s\n%v", job.Video.Title, err)
+			failed++
+			continue
+		}
+		fmt.Println(formatCommand(editor.Path, args))
+		if editor.Metadata != nil && editor.Metadata.Enabled {
+			fmt.Println(formatCommand(editor.Path, editor.tagCommand(job, dst)))
+		}
+
+		if task.variant != "" {
+			continue
+		}
+		if !task.short {
+			logState(task.track.Path, task.track.State, Scheduled)
+			for _, a := range task.art {
+				logState(a.Path, a.State, Scheduled)
+			}
+		}
+		logState(job.Video.Path, job.Video.State, Scheduled)
+	}
+	return failed
+}
+
+// Print the request body of each upload and the state changes uploading
+// would make.
+func (self *UploadCommand) planUpload(c *Collections, videos []*Video) {
+	failed := 0
+	for _, v := range videos {
+		linkShort(c, v)
+		userLog("upload:", v.Path)
+		if !fileExists(v.Path) {
+			printError(Err_FileNotFound, v.Path)
+			failed++
+		}
+
+		body, err := json.MarshalIndent(self.uploadBody(v), "", "  ")
+		if err != nil {
+			printError("upload: %s\n%v", v.Title, err)
+			failed++
+			continue
+		}
+		fmt.Println(string(body))
+
+		logState(v.Path, v.State, Published)
+		for _, id := range v.AudioIds() {
+			if track, ok := c.Find(id); ok {
+				logState(id, track.(*Track).State, Published)
+			}
+		}
+		for _, id := range v.ImageIds() {
+			if art, ok := c.Find(id); ok {
+				logState(id, art.(*Artwork).State, Published)
+			}
+		}
+	}
+	if failed > 0 {
+		userError(Err_DryRun, failed)
+	}
+}
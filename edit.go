@@ -0,0 +1,143 @@
+package main
+
+import "context"
+
+const (
+	Err_UnknownCollection = "Unknown collection '%s' (expected music or art)."
+	Err_NoBufferedItem    = "No buffered %s at index %d."
+)
+
+type EditOptions struct {
+	Index int `opt:"-i"`
+}
+
+type EditCommand struct {
+	CollectionName string
+	Values         AddOptions
+	// Used to detect silence when trimming music
+	Editor  Editor
+	Options EditOptions
+}
+
+func (self *EditCommand) Exec(ctx context.Context, c *Collections) {
+	if self.Options.Index < 1 {
+		self.Options.Index = 1
+	}
+
+	switch self.CollectionName {
+	case "music":
+		track := findBufferedTrack(c, self.Options.Index)
+		if track == nil {
+			userError(Err_NoBufferedItem, "music", self.Options.Index)
+		}
+		EditTrack(c, track, self.Values)
+		trimSilence(ctx, &self.Editor, track, self.Values)
+		userLog("edit:", track.Path)
+
+	case "art":
+		art := findBufferedArtwork(c, self.Options.Index)
+		if art == nil {
+			userError(Err_NoBufferedItem, "art", self.Options.Index)
+		}
+		EditArtwork(c, art, self.Values)
+		userLog("edit:", art.Path)
+
+	default:
+		userError(Err_UnknownCollection, self.CollectionName)
+	}
+}
+
+// Update track fields with values that are set in opt. Artists are
+// inferred again if the title or artist changed and no artists are
+// given explicitly.
+func EditTrack(c *Collections, track *Track, opt AddOptions) {
+	if opt.Name != "" {
+		track.Title = opt.Name
+	}
+	if opt.By != "" {
+		track.By = opt.By
+	}
+	if opt.Artist != "" || opt.Name != "" || opt.By != "" {
+		track.Artists = inferArtists(track.Title, track.By, opt)
+		updateArtists(c, track.Artists...)
+	}
+	if opt.Desc != "" {
+		track.Description = opt.Desc
+	}
+	if opt.Profile != "" {
+		track.Profile = opt.Profile
+	}
+	if opt.Viz != "" {
+		track.Visualizer = opt.Viz
+	}
+
+	trim := track.Trim
+	if opt.Start != 0 {
+		track.Trim.Start = opt.Start
+	}
+	if opt.End != 0 {
+		track.Trim.End = opt.End
+	}
+	if opt.FadeIn != 0 {
+		track.Trim.FadeIn = opt.FadeIn
+	}
+	if opt.FadeOut != 0 {
+		track.Trim.FadeOut = opt.FadeOut
+	}
+	// Loudness is measured over the trimmed audio
+	if track.Trim.Start != trim.Start || track.Trim.End != trim.End || opt.Trim {
+		track.Loudness = nil
+	}
+}
+
+// Update artwork fields with values that are set in opt
+func EditArtwork(c *Collections, art *Artwork, opt AddOptions) {
+	if opt.Artist != "" {
+		art.Artist = opt.Artist
+		updateArtists(c, art.Artist)
+	}
+	if opt.Profile != "" {
+		art.Profile = opt.Profile
+	}
+	if opt.Set != "" {
+		art.Set = opt.Set
+	}
+	if opt.Seconds != 0 {
+		art.Duration = float64(opt.Seconds)
+	}
+	if opt.Motion != "" {
+		art.Motion.Preset = opt.Motion
+	}
+	if opt.Speed != 0 {
+		art.Motion.Speed = opt.Speed
+	}
+	if opt.Focus != "" {
+		art.Motion.Focus = opt.Focus
+	}
+}
+
+// Find the nth most recent buffered track, starting at 1
+func findBufferedTrack(c *Collections, n int) *Track {
+	for i := len(c.Tracks) - 1; i >= 0; i-- {
+		if c.Tracks[i].State != Buffered {
+			continue
+		}
+		if n--; n == 0 {
+			return c.Tracks[i]
+		}
+	}
+	return nil
+}
+
+// Find the nth most recent buffered artwork, starting at 1
+func findBufferedArtwork(c *Collections, n int) *Artwork {
+	for i := len(c.Artwork) - 1; i >= 0; i-- {
+		if c.Artwork[i].State != Buffered {
+			continue
+		}
+		if n--; n == 0 {
+			return c.Artwork[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of stderr lines included in errors when ffmpeg fails
+const ffmpegErrorLines = 8
+
+type RenderStatus struct {
+	// Percent of the output rendered, negative if the total duration
+	// is not known.
+	Percent float64
+	Speed   float64
+	ETA     time.Duration
+}
+
+// Run ffmpeg with progress reporting enabled. Progress is computed from
+// the duration of the output in seconds, stderr is written to logPath
+// when set and the last lines of it are included in the returned error.
+// The ffmpeg process is killed when ctx is done.
+func runFfmpeg(ctx context.Context, path string, args []string, duration float64, logPath string, progress func(RenderStatus)) error {
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, path, args...)
+
+	tail := new(tailBuffer)
+	var stderr io.Writer = tail
+
+	if logPath != "" {
+		os.MkdirAll(filepath.Dir(logPath), os.ModePerm)
+		log, err := os.Create(logPath)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+		fmt.Fprintf(log, "%s %s\n\n", path, strings.Join(args, " "))
+		stderr = io.MultiWriter(log, tail)
+	}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	readProgress(stdout, duration, progress)
+
+	if err = cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		msg := fmt.Sprintf("ffmpeg: %v\n%s", err, tail.Lines(ffmpegErrorLines))
+		if logPath != "" {
+			msg += fmt.Sprintf("\n(see %s)", logPath)
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// Parse key=value pairs written by ffmpeg -progress, a status is
+// reported at the end of each block of values.
+func readProgress(r io.Reader, duration float64, progress func(RenderStatus)) {
+	scanner := bufio.NewScanner(r)
+	var status RenderStatus
+	var outTime float64
+
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := kv[0], strings.TrimSpace(kv[1])
+
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// out_time_ms is also in microseconds
+			if us, err := strconv.ParseFloat(val, 64); err == nil {
+				outTime = us / 1e6
+			}
+		case "speed":
+			s, err := strconv.ParseFloat(strings.TrimSuffix(val, "x"), 64)
+			if err == nil {
+				status.Speed = s
+			}
+		case "progress":
+			if progress == nil {
+				continue
+			}
+			status.Percent = -1
+			status.ETA = 0
+			if duration > 0 {
+				status.Percent = clampFloat(outTime/duration*100, 0, 100)
+				if status.Speed > 0 {
+					eta := (duration - outTime) / status.Speed
+					status.ETA = time.Duration(eta * float64(time.Second))
+				}
+			}
+			if val == "end" {
+				status.Percent = 100
+				status.ETA = 0
+			}
+			progress(status)
+		}
+	}
+}
+
+func (self RenderStatus) String() string {
+	if self.Percent < 0 {
+		return fmt.Sprintf("%.1fx", self.Speed)
+	}
+	eta := self.ETA.Round(time.Second)
+	return fmt.Sprintf("%3.0f%% %.1fx eta %s", self.Percent, self.Speed, eta)
+}
+
+// A tailBuffer keeps the last few kilobytes written to it
+type tailBuffer struct {
+	buf []byte
+}
+
+func (self *tailBuffer) Write(p []byte) (int, error) {
+	const size = 8 * 1024
+	self.buf = append(self.buf, p...)
+	if len(self.buf) > size {
+		self.buf = self.buf[len(self.buf)-size:]
+	}
+	return len(p), nil
+}
+
+// Last n lines written to the buffer
+func (self *tailBuffer) Lines(n int) string {
+	lines := strings.Split(strings.TrimSpace(string(self.buf)), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func clampFloat(x, min, max float64) float64 {
+	if x < min {
+		return min
+	}
+	if x > max {
+		return max
+	}
+	return x
+}
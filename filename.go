@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest file name in bytes, leaving room for the extension and the
+// suffixes added to shorts and variants.
+const maxFileName = 180
+
+// Characters that are not allowed in file names on some platform
+const invalidFileChars = `<>:"/\|?*`
+
+// Names reserved by Windows, with or without an extension
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Path of the video relative to the schedule directory without an
+// extension. Each / in the FileName template starts a subdirectory,
+// values are sanitized so they never do.
+func (self *VideoBuilder) FileName() (string, error) {
+	title, err := self.Title()
+	if err != nil {
+		return "", err
+	}
+	date := time.Now()
+	if self.PublishAt != nil {
+		date = *self.PublishAt
+	}
+
+	template := Template{"video": title, "date": date.Format("2006-01-02"),
+		"month": date.Format("2006-01")}
+	for k, v := range self.Template() {
+		template[k] = v
+	}
+	for k, v := range template {
+		template[k] = sanitizeFileName(v)
+	}
+
+	format := self.Format.FileName
+	if format == "" {
+		format = "%(video)"
+	}
+	name, err := buildTemplate(format, template)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = sanitizeFileName(parts[i])
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Make a name valid as a file name on every platform. Invalid and
+// control characters are replaced with _, trailing dots and spaces are
+// removed and long names are cut.
+func sanitizeFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 32 || r == 127 || strings.ContainsRune(invalidFileChars, r) {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	name = b.String()
+
+	if len(name) > maxFileName {
+		name = name[:maxFileName]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedFileNames[base] {
+		name = "_" + name
+	}
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// Add a (2), (3)... suffix to a path used by another video, an existing
+// file or a path in taken. Paths are compared ignoring case as file
+// systems on macOS and Windows do. The returned path is added to taken
+// in lower case.
+func uniqueVideoPath(c *Collections, taken map[string]bool, name, ext string) string {
+	used := func(p string) bool {
+		if taken[strings.ToLower(p)] || fileExists(p) {
+			return true
+		}
+		for _, v := range c.Schedule {
+			if strings.EqualFold(v.Path, p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	p := name + ext
+	for i := 2; used(p); i++ {
+		p = fmt.Sprintf("%s (%d)%s", name, i, ext)
+	}
+	if taken != nil {
+		taken[strings.ToLower(p)] = true
+	}
+	return p
+}
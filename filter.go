@@ -0,0 +1,544 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	Err_InvalidVisualizer = "Visualizer preset '%s' is not valid (expected wave, circle or freqs)."
+	Err_CanvasRequired    = "A canvas size is required to render %s."
+	Err_SlideDuration     = "Slide durations (%gs) exceed the track duration (%gs)."
+	Err_UnknownDuration   = "Track duration is required to render %s."
+)
+
+const (
+	VisualizerNone = ""
+	// Disable a visualizer set by the render profile
+	VisualizerOff = "none"
+	// Waveform bar
+	VisualizerWave = "wave"
+	// Frequency bars wrapped around a circle
+	VisualizerCircle = "circle"
+	// Frequency spectrum drawn as a line
+	VisualizerFreqs = "freqs"
+)
+
+// Visualizer drawn on top of the artwork, Position is one of top,
+// center, bottom or an overlay x:y expression. Width and Height default
+// to the canvas width and a fifth of the canvas height. A frame rate set
+// with -r in OutputArgs is ignored when a visualizer is drawn.
+type Visualizer struct {
+	Preset   string
+	Color    string
+	Position string
+	Width    int
+	Height   int
+	Rate     int
+}
+
+// Text drawn over the video. Text is a template using the same keys as
+// the video title, Position is a named position such as bottom-left or
+// drawtext x=...:y=... expressions. End is in seconds from the start of
+// the video, zero shows the text until the end. Fades are only smooth
+// when the profile renders at a frame rate higher than 1.
+type TextLayer struct {
+	Text        string
+	FontFile    string
+	FontSize    int
+	Color       string
+	ShadowColor string
+	Shadow      int
+	Position    string
+	Margin      int
+	Start       float64
+	End         float64
+	FadeIn      float64
+	FadeOut     float64
+}
+
+// A filterGraph builds an ffmpeg -filter_complex graph. The current
+// video and audio streams are tracked as each filter is added, streams
+// are either input specifiers such as 0:v or labels of filter outputs.
+type filterGraph struct {
+	chains []string
+	count  int
+	video  string
+	audio  string
+	// Arguments for inputs added by filters and the number of inputs
+	// already passed to ffmpeg before them.
+	inputs    []string
+	numInputs int
+	// Frame rate of the video output when filters animate it, zero when
+	// the output is a still image.
+	rate float64
+}
+
+func newFilterGraph(video, audio string, numInputs int) *filterGraph {
+	return &filterGraph{video: video, audio: audio, numInputs: numInputs}
+}
+
+// Add an ffmpeg input, args should end with -i and the input path.
+// Returns the specifier of the first stream of the input.
+func (self *filterGraph) Input(args ...string) string {
+	self.inputs = append(self.inputs, args...)
+	self.numInputs++
+	return fmt.Sprintf("%d", self.numInputs-1)
+}
+
+// Add a filter chain reading from inputs and return its output label
+func (self *filterGraph) Add(chain string, inputs ...string) string {
+	return self.AddN(chain, 1, inputs...)[0]
+}
+
+// Add a filter chain with n outputs reading from inputs
+func (self *filterGraph) AddN(chain string, n int, inputs ...string) []string {
+	var b strings.Builder
+	for _, in := range inputs {
+		fmt.Fprintf(&b, "[%s]", in)
+	}
+	b.WriteString(chain)
+
+	outputs := make([]string, n)
+	for i := range outputs {
+		self.count++
+		outputs[i] = fmt.Sprintf("s%d", self.count)
+		fmt.Fprintf(&b, "[%s]", outputs[i])
+	}
+	self.chains = append(self.chains, b.String())
+	return outputs
+}
+
+// Apply a filter chain to the current video stream
+func (self *filterGraph) VideoFilter(chain string) {
+	self.video = self.Add(chain, self.video)
+}
+
+// Apply a filter chain to the current audio stream
+func (self *filterGraph) AudioFilter(chain string) {
+	self.audio = self.Add(chain, self.audio)
+}
+
+// Copy of the current audio stream for filters that only read it, the
+// output of a filter can only be used as an input once.
+func (self *filterGraph) AudioTap() string {
+	if strings.Contains(self.audio, ":") {
+		return self.audio
+	}
+	out := self.AddN("asplit", 2, self.audio)
+	self.audio = out[0]
+	return out[1]
+}
+
+func (self *filterGraph) Empty() bool {
+	return len(self.chains) == 0
+}
+
+func (self *filterGraph) String() string {
+	return strings.Join(self.chains, ";")
+}
+
+// Argument for -map selecting a stream in the graph
+func mapStream(stream string) string {
+	if strings.Contains(stream, ":") {
+		return stream
+	}
+	return "[" + stream + "]"
+}
+
+// Specifier selecting a stream of a given type from an input
+func inputStream(input, kind string) string {
+	return input + ":" + kind
+}
+
+// Build the filter graph applied to the artwork and audio inputs
+func (self *Editor) filters(job *RenderJob) (*filterGraph, error) {
+	g := newFilterGraph("0:v", "1:a", 2)
+
+	if len(job.Slides) > 1 {
+		if err := self.applySlideshow(g, job.Slides, job.Duration); err != nil {
+			return nil, err
+		}
+	} else if len(job.Slides) == 1 && job.Slides[0].Rate > 0 {
+		if err := self.applyLoop(g, job.Slides[0]); err != nil {
+			return nil, err
+		}
+	} else if len(job.Slides) == 1 {
+		if err := self.applyMotion(g, job.Slides[0], job.Duration); err != nil {
+			return nil, err
+		}
+	}
+	if len(job.Segments) > 0 {
+		if err := self.applyMix(g, job.Segments, job.Crossfade); err != nil {
+			return nil, err
+		}
+	} else if err := job.Trim.apply(g); err != nil {
+		return nil, err
+	}
+	self.Loudness.apply(g, job.Loudness)
+	if err := job.Trim.applyFades(g, job.Duration); err != nil {
+		return nil, err
+	}
+	if err := self.Visualizer.apply(g, self.Canvas); err != nil {
+		return nil, err
+	}
+	for i := range self.Text {
+		err := self.Text[i].apply(g, job.Template, job.Duration)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if self.Branding != nil {
+		if err := self.Branding.Watermark.apply(g, self.Canvas); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Show slides one after another with a crossfade between them. The
+// first slide is input 0, the other slides are added as looped inputs.
+func (self *Editor) applySlideshow(g *filterGraph, slides []Slide, duration float64) error {
+	if len(slides) < 2 {
+		return nil
+	}
+	if self.Canvas == "" {
+		return fmt.Errorf(Err_CanvasRequired, "a slideshow")
+	}
+	w, h, err := parseCanvas(self.Canvas)
+	if err != nil {
+		return err
+	}
+	durations, err := slideDurations(slides, duration)
+	if err != nil {
+		return err
+	}
+
+	// Every slide must have the same size and frame rate for xfade
+	rate := self.frameRate()
+	chain := func(i int) (string, error) {
+		norm := canvasFilter(w, h, float64(rate))
+		motion := slides[i].Motion.Merge(self.Motion)
+		if slides[i].Rate > 0 || !motion.enabled(duration) {
+			return norm, nil
+		}
+		zoom, err := motion.filter(w, h, rate, durations[i])
+		if err != nil {
+			return "", err
+		}
+		return norm + "," + zoom, nil
+	}
+
+	first, err := chain(0)
+	if err != nil {
+		return err
+	}
+	g.VideoFilter(first)
+
+	start := 0.0
+	for i := 1; i < len(slides); i++ {
+		norm, err := chain(i)
+		if err != nil {
+			return err
+		}
+		loop := []string{"-loop", "1"}
+		if slides[i].Rate > 0 {
+			loop = []string{"-stream_loop", "-1"}
+		}
+		input := g.Input(append(loop, "-i", slides[i].Image)...)
+		slide := g.Add(norm, inputStream(input, "v"))
+		start += durations[i-1]
+
+		// xfade needs a duration, no crossfade is a one frame fade
+		fade := math.Min(self.SlideCrossfade, math.Min(durations[i-1], durations[i]))
+		if fade <= 0 {
+			fade = 1 / float64(rate)
+		}
+		g.video = g.Add(fmt.Sprintf("xfade=transition=fade:duration=%g:offset=%g",
+			fade, math.Max(start-fade, 0)), g.video, slide)
+	}
+	g.rate = float64(rate)
+	return nil
+}
+
+// Zoom or pan over a single image for the whole video
+func (self *Editor) applyMotion(g *filterGraph, slide Slide, duration float64) error {
+	motion := slide.Motion.Merge(self.Motion)
+	if !motion.enabled(duration) {
+		return nil
+	}
+	if self.Canvas == "" {
+		return fmt.Errorf(Err_CanvasRequired, "motion")
+	}
+	w, h, err := parseCanvas(self.Canvas)
+	if err != nil {
+		return err
+	}
+
+	rate := self.frameRate()
+	zoom, err := motion.filter(w, h, rate, duration)
+	if err != nil {
+		return err
+	}
+	g.VideoFilter(canvasFilter(w, h, float64(rate)) + "," + zoom)
+	g.rate = float64(rate)
+	return nil
+}
+
+// Play an animated image at its own frame rate, the input is looped by
+// LoopInputArgs and cut to the audio length with -shortest.
+func (self *Editor) applyLoop(g *filterGraph, slide Slide) error {
+	if self.Canvas == "" {
+		g.VideoFilter(fmt.Sprintf("fps=%g,format=yuv420p", slide.Rate))
+		return nil
+	}
+	w, h, err := parseCanvas(self.Canvas)
+	if err != nil {
+		return err
+	}
+	g.VideoFilter(canvasFilter(w, h, slide.Rate))
+	return nil
+}
+
+// Fit a video stream inside a w by h canvas with a constant frame rate
+func canvasFilter(w, h int, rate float64) string {
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,"+
+		"pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%g,format=yuv420p",
+		w, h, w, h, rate)
+}
+
+// Seconds each slide is shown, slides without a duration share the time
+// left over by the other slides evenly.
+func slideDurations(slides []Slide, total float64) ([]float64, error) {
+	durations := make([]float64, len(slides))
+	fixed := 0.0
+	even := 0
+	for i, s := range slides {
+		durations[i] = s.Duration
+		fixed += s.Duration
+		if s.Duration <= 0 {
+			even++
+		}
+	}
+	if even == 0 {
+		return durations, nil
+	}
+
+	if total <= 0 {
+		return nil, fmt.Errorf(Err_UnknownDuration, "a slideshow")
+	}
+	if fixed >= total {
+		return nil, fmt.Errorf(Err_SlideDuration, fixed, total)
+	}
+	for i := range durations {
+		if durations[i] <= 0 {
+			durations[i] = (total - fixed) / float64(even)
+		}
+	}
+	return durations, nil
+}
+
+func (self *Editor) frameRate() int {
+	if self.FrameRate > 0 {
+		return self.FrameRate
+	}
+	return 25
+}
+
+func (self *Visualizer) apply(g *filterGraph, canvas string) error {
+	if self.Preset == VisualizerNone || self.Preset == VisualizerOff {
+		return nil
+	}
+	if canvas == "" {
+		return fmt.Errorf(Err_CanvasRequired, "a visualizer")
+	}
+	cw, ch, err := parseCanvas(canvas)
+	if err != nil {
+		return err
+	}
+
+	w, h, rate := self.Width, self.Height, self.Rate
+	if w <= 0 {
+		w = cw
+	}
+	if h <= 0 {
+		h = ch / 5
+	}
+	if rate <= 0 {
+		rate = 25
+	}
+	color := self.Color
+	if color == "" {
+		color = "white"
+	}
+
+	var src string
+	switch self.Preset {
+	case VisualizerWave:
+		src = fmt.Sprintf("showwaves=s=%dx%d:mode=cline:colors=%s:r=%d",
+			w, h, color, rate)
+	case VisualizerFreqs:
+		src = fmt.Sprintf("showfreqs=s=%dx%d:mode=line:fscale=log:colors=%s:rate=%d",
+			w, h, color, rate)
+	case VisualizerCircle:
+		// Draw frequency bars on a square then wrap them around a ring
+		// using polar coordinates, the inner half of the ring is empty.
+		if h > w {
+			w = h
+		}
+		src = fmt.Sprintf("showfreqs=s=%dx%d:mode=bar:fscale=log:colors=%s:rate=%d,"+
+			"format=rgba,geq=%s", w, w, color, rate, polarExpr())
+	default:
+		return fmt.Errorf(Err_InvalidVisualizer, self.Preset)
+	}
+
+	viz := g.Add(src+",format=rgba", g.AudioTap())
+	// Still artwork is rendered at a low frame rate which is too low
+	// for a visualizer.
+	g.VideoFilter(fmt.Sprintf("fps=%d", rate))
+	g.video = g.Add(
+		fmt.Sprintf("overlay=%s:shortest=1", overlayPosition(self.Position, 0)),
+		g.video, viz)
+	g.rate = float64(rate)
+	return nil
+}
+
+func (self *TextLayer) apply(g *filterGraph, template Template, duration float64) error {
+	text, err := buildTemplate(self.Text, template)
+	if err != nil {
+		return err
+	}
+
+	size := self.FontSize
+	if size <= 0 {
+		size = 48
+	}
+	color := self.Color
+	if color == "" {
+		color = "white"
+	}
+
+	// Text expansion is disabled so titles containing % are drawn as is
+	opts := []string{
+		"expansion=none",
+		"text=" + escapeFilterValue(text),
+		fmt.Sprintf("fontsize=%d", size),
+		"fontcolor=" + color,
+		textPosition(self.Position, self.Margin),
+	}
+	if self.FontFile != "" {
+		opts = append(opts, "fontfile="+escapeFilterValue(self.FontFile))
+	}
+	if self.ShadowColor != "" {
+		opts = append(opts,
+			"shadowcolor="+self.ShadowColor,
+			fmt.Sprintf("shadowx=%d:shadowy=%d", self.Shadow, self.Shadow))
+	}
+
+	end := self.End
+	if end <= 0 {
+		end = duration
+	}
+	if self.Start > 0 || self.End > 0 {
+		expr := fmt.Sprintf("gte(t,%g)", self.Start)
+		if end > 0 {
+			expr = fmt.Sprintf("between(t,%g,%g)", self.Start, end)
+		}
+		opts = append(opts, "enable="+escapeFilterValue(expr))
+	}
+	if alpha := fadeExpr(self.Start, end, self.FadeIn, self.FadeOut); alpha != "" {
+		opts = append(opts, "alpha="+escapeFilterValue(alpha))
+	}
+
+	g.VideoFilter("drawtext=" + strings.Join(opts, ":"))
+	return nil
+}
+
+// Expression for the opacity of an element visible from start to end
+// seconds, fading in and out. The fade out is skipped if end is unknown.
+func fadeExpr(start, end, fadeIn, fadeOut float64) string {
+	alpha := "1"
+	if fadeOut > 0 && end > 0 {
+		alpha = fmt.Sprintf("if(lt(t,%g),1,max((%g-t)/%g,0))", end-fadeOut, end, fadeOut)
+	}
+	if fadeIn > 0 {
+		alpha = fmt.Sprintf("if(lt(t,%g),max((t-%g)/%g,0),%s)", start+fadeIn, start, fadeIn, alpha)
+	}
+	if alpha == "1" {
+		return ""
+	}
+	return alpha
+}
+
+// Escape a value for use as a filter option inside a filter graph, the
+// value is escaped once for the option parser and once for the graph.
+func escapeFilterValue(s string) string {
+	option := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	graph := strings.NewReplacer(
+		`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+	return graph.Replace(option.Replace(s))
+}
+
+// Convert a named position to drawtext x and y expressions, anything
+// else is used as is.
+func textPosition(pos string, margin int) string {
+	const center = "(w-text_w)/2"
+	switch pos {
+	case "top":
+		return fmt.Sprintf("x=%s:y=%d", center, margin)
+	case "center":
+		return fmt.Sprintf("x=%s:y=(h-text_h)/2", center)
+	case "bottom":
+		return fmt.Sprintf("x=%s:y=h-text_h-%d", center, margin)
+	case "top-left":
+		return fmt.Sprintf("x=%d:y=%d", margin, margin)
+	case "top-right":
+		return fmt.Sprintf("x=w-text_w-%d:y=%d", margin, margin)
+	case "", "bottom-left":
+		return fmt.Sprintf("x=%d:y=h-text_h-%d", margin, margin)
+	case "bottom-right":
+		return fmt.Sprintf("x=w-text_w-%d:y=h-text_h-%d", margin, margin)
+	}
+	return pos
+}
+
+// geq expression mapping each pixel to polar coordinates, the angle
+// selects the frequency and the distance from the center the amplitude.
+func polarExpr() string {
+	const (
+		radius = "hypot(X-W/2,Y-H/2)"
+		angle  = "(atan2(Y-H/2,X-W/2)+PI)/(2*PI)*(W-1)"
+		// Distance from the inner ring mapped to a row in the spectrum
+		row = "H-1-(" + radius + "-W/4)/(W/4)*(H-1)"
+		// Only draw pixels inside the ring
+		ring = "between(" + radius + ",W/4,W/2)"
+	)
+	channel := func(c string) string {
+		return fmt.Sprintf("'%s(%s,%s)'", c, angle, row)
+	}
+	return fmt.Sprintf("r=%s:g=%s:b=%s:a='%s*alpha(%s,%s)'",
+		channel("r"), channel("g"), channel("b"), ring, angle, row)
+}
+
+// Convert a named position to an overlay x:y expression with margin in
+// pixels from the edges. Unknown names are used as an expression as is.
+func overlayPosition(pos string, margin int) string {
+	switch pos {
+	case "top":
+		return fmt.Sprintf("(W-w)/2:%d", margin)
+	case "", "bottom":
+		return fmt.Sprintf("(W-w)/2:H-h-%d", margin)
+	case "center":
+		return "(W-w)/2:(H-h)/2"
+	case "top-left":
+		return fmt.Sprintf("%d:%d", margin, margin)
+	case "top-right":
+		return fmt.Sprintf("W-w-%d:%d", margin, margin)
+	case "bottom-left":
+		return fmt.Sprintf("%d:H-h-%d", margin, margin)
+	case "bottom-right":
+		return fmt.Sprintf("W-w-%d:H-h-%d", margin, margin)
+	}
+	return pos
+}
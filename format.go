@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const Err_ConvertArtwork = "Could not convert '%s' to png (%v)."
+
+// Extensions of image formats recognized by sniffImage
+var imageExtensions = map[string]string{
+	"png":  ".png",
+	"jpeg": ".jpg",
+	"gif":  ".gif",
+	"bmp":  ".bmp",
+	"webp": ".webp",
+	"avif": ".avif",
+	"tiff": ".tiff",
+}
+
+// Formats converted to png when artwork is added since they are not
+// decoded consistently by ffmpeg builds and the standard library.
+var convertFormats = map[string]bool{
+	"webp": true,
+	"avif": true,
+	"tiff": true,
+}
+
+// Detect the format of an image file from its first bytes, returns an
+// empty string if the format is not recognized.
+func sniffImage(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 16)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return imageFormat(head[:n]), nil
+}
+
+func imageFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(head, []byte("BM")):
+		return "bmp"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "webp"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" &&
+		(string(head[8:12]) == "avif" || string(head[8:12]) == "avis"):
+		return "avif"
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "tiff"
+	}
+	return ""
+}
+
+// Convert artwork in a format listed in convertFormats to a png next to
+// the original file. The original is kept and recorded in art.Original.
+func (self *Editor) ConvertArtwork(ctx context.Context, art *Artwork) error {
+	format, err := sniffImage(art.Path)
+	if err != nil {
+		return err
+	}
+	if !convertFormats[format] {
+		return nil
+	}
+
+	dst := strings.TrimSuffix(art.Path, filepath.Ext(art.Path)) + ".png"
+	if dst == art.Path {
+		// A webp file named .png would be overwritten by its conversion
+		dst = strings.TrimSuffix(dst, ".png") + "." + format + ".png"
+	}
+
+	// Convert to a temporary file first so a failed conversion never
+	// leaves a truncated png behind.
+	tmp := dst + ".part"
+	args := []string{"-y", "-i", art.Path, "-frames:v", "1", "-c:v", "png", "-f", "image2", tmp}
+	if err := runFfmpeg(ctx, self.Path, args, 0, "", nil); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	art.Original = art.Path
+	art.Path = dst
+	return nil
+}
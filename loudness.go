@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+)
+
+const Err_MeasureLoudness = "Could not measure loudness of '%s' (%v)."
+
+// EBU R128 loudness normalization applied to the audio when Enabled.
+// Target is the integrated loudness in LUFS, TruePeak the maximum true
+// peak in dBTP and Range the loudness range in LU. Tracks further than
+// Window LU from the target are listed by the loudness command.
+type Loudness struct {
+	Enabled  bool
+	Target   float64
+	TruePeak float64
+	Range    float64
+	Window   float64
+}
+
+// Loudness of a track measured by the first loudnorm pass
+type LoudnessInfo struct {
+	Integrated float64
+	TruePeak   float64
+	Range      float64
+	Threshold  float64
+	Offset     float64
+}
+
+// Values printed by loudnorm with print_format=json
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+type LoudnessOptions struct {
+	Profile string `opt:"-p"`
+	Force   bool   `opt:"-f"`
+}
+
+type LoudnessCommand struct {
+	Profile func(name string) (Editor, error)
+	Options LoudnessOptions
+}
+
+// Measure buffered tracks that have not been measured yet and list the
+// tracks outside the target loudness window.
+func (self *LoudnessCommand) Exec(ctx context.Context, c *Collections) {
+	editor, err := self.Profile(self.Options.Profile)
+	if err != nil {
+		userError(err.Error())
+	}
+	target := editor.Loudness
+
+	outside := 0
+	for _, track := range c.Tracks {
+		if track.State != Buffered {
+			continue
+		}
+		if track.Loudness == nil || self.Options.Force {
+			info, err := editor.MeasureLoudness(ctx, track.Path, track.Trim)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				printError(Err_MeasureLoudness, track.Path, err)
+				continue
+			}
+			track.Loudness = info
+		}
+
+		l := track.Loudness
+		if target.Contains(l) {
+			continue
+		}
+		outside++
+		fmt.Printf("%6.1f LUFS %5.1f dBTP  %s - %s\n",
+			l.Integrated, l.TruePeak, track.By, track.Title)
+	}
+
+	userLog("loudness:", "%d tracks outside %g LUFS (±%g LU, %g dBTP)",
+		outside, target.Target, target.Window, target.TruePeak)
+}
+
+// Whether a measured track is within the target window and peak
+func (self *Loudness) Contains(l *LoudnessInfo) bool {
+	return math.Abs(l.Integrated-self.Target) <= self.Window && l.TruePeak <= self.TruePeak
+}
+
+// Run the first loudnorm pass over the trimmed part of a file, which
+// only analyzes the audio.
+func (self *Editor) MeasureLoudness(ctx context.Context, path string, trim Trim) (*LoudnessInfo, error) {
+	cmd := exec.CommandContext(ctx, self.Path, self.loudnessArgs(path, trim)...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ffmpeg: %v", err)
+	}
+	return parseLoudnorm(stderr.Bytes())
+}
+
+// Build the ffmpeg arguments of the first loudnorm pass
+func (self *Editor) loudnessArgs(path string, trim Trim) []string {
+	filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json",
+		self.Loudness.Target, self.Loudness.TruePeak, self.Loudness.Range)
+
+	args := []string{"-hide_banner", "-nostats"}
+	if trim.Start > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%g", trim.Start))
+	}
+	if trim.End > 0 {
+		args = append(args, "-to", fmt.Sprintf("%g", trim.End))
+	}
+	return append(args, "-i", path, "-vn", "-af", filter, "-f", "null", "-")
+}
+
+// Parse the json block loudnorm prints at the end of its output
+func parseLoudnorm(out []byte) (*LoudnessInfo, error) {
+	start := bytes.LastIndexByte(out, '{')
+	end := bytes.LastIndexByte(out, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("loudnorm: no measurement in output")
+	}
+
+	var stats loudnormStats
+	if err := json.Unmarshal(out[start:end+1], &stats); err != nil {
+		return nil, fmt.Errorf("loudnorm: %v", err)
+	}
+
+	var values [5]float64
+	for i, s := range []string{
+		stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset,
+	} {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			// Silent audio is measured as -inf
+			return nil, fmt.Errorf("loudnorm: invalid measurement '%s'", s)
+		}
+		values[i] = v
+	}
+	return &LoudnessInfo{
+		Integrated: values[0],
+		TruePeak:   values[1],
+		Range:      values[2],
+		Threshold:  values[3],
+		Offset:     values[4],
+	}, nil
+}
+
+// Second loudnorm pass using the measured values, linear normalization
+// keeps the dynamics of the track when the target allows it. loudnorm
+// upsamples to 192kHz so audio is resampled back to 48kHz.
+func (self *Loudness) apply(g *filterGraph, info *LoudnessInfo) {
+	if !self.Enabled {
+		return
+	}
+	filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", self.Target, self.TruePeak, self.Range)
+	if info != nil {
+		filter += fmt.Sprintf(":measured_I=%g:measured_TP=%g:measured_LRA=%g:"+
+			"measured_thresh=%g:offset=%g:linear=true",
+			info.Integrated, info.TruePeak, info.Range, info.Threshold, info.Offset)
+	}
+	g.AudioFilter(filter + ",aresample=48000")
+}
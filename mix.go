@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	Err_MixTracks       = "A mix needs at least %d buffered tracks, found %d."
+	Err_MixName         = "A mix needs a title (use -n)."
+	Err_MixLength       = "Crossfade (%gs) is longer than a track of the mix (%gs)."
+	Err_ChapterCount    = "YouTube needs at least %d chapters, found %d."
+	Err_ChapterTooShort = "Chapter '%s' is %.1fs, YouTube needs chapters of at least %gs."
+	Err_ChapterStart    = "Chapter '%s' starts at %s, YouTube needs the first chapter to start at 0:00."
+)
+
+// Chapters are only shown by YouTube when there are at least
+// minChapters, each at least minChapterLength seconds long.
+const (
+	minChapters      = 3
+	minChapterLength = 10
+)
+
+// A chapter of a video, in seconds from the start of the video
+type Chapter struct {
+	Start float64
+	Title string
+	By    string
+}
+
+// A track of a mix read from its own file
+type Segment struct {
+	Path string
+	Trim Trim
+	// Duration of the audio file in seconds
+	Duration float64
+}
+
+type MixOptions struct {
+	Name      string  `opt:"-n"`
+	Count     int     `opt:"-c"`
+	Crossfade float64 `opt:"-x"`
+	Cue       string  `opt:"-cue"`
+	Set       string  `opt:"-set"`
+	Profile   string  `opt:"-p"`
+}
+
+// Render several tracks as a single video. Render settings and the time
+// slot of the video are taken from Schedule.
+type MixCommand struct {
+	DataDir  string
+	Schedule ScheduleCommand
+	Options  MixOptions
+}
+
+func (self *MixCommand) Exec(ctx context.Context, c *Collections) {
+	var tracks []*Track
+	var chapters []Chapter
+	name := self.Options.Name
+
+	if self.Options.Cue != "" {
+		track, sheet := self.addCueTrack(c)
+		tracks = []*Track{track}
+		if name == "" {
+			name = sheet.Title
+		}
+	} else {
+		for _, t := range c.Tracks {
+			if t.State == Buffered {
+				tracks = append(tracks, t)
+			}
+		}
+		if self.Options.Count > 0 && self.Options.Count < len(tracks) {
+			tracks = tracks[:self.Options.Count]
+		}
+		if len(tracks) < minChapters {
+			userError(Err_MixTracks, minChapters, len(tracks))
+		}
+	}
+	if name == "" {
+		userError(Err_MixName)
+	}
+
+	art := mixArtwork(c, self.Options.Set)
+	if len(art) == 0 {
+		userError(Err_NoBufferedArtwork)
+	}
+
+	profile := RenderProfile{Name: self.Options.Profile}
+	editor, err := self.Schedule.Editor(profile)
+	if err != nil {
+		userError(err.Error())
+	}
+	for _, t := range tracks {
+		if t.Duration != 0 && t.Codec != "" {
+			continue
+		}
+		info, err := editor.Probe(t.Path)
+		if err != nil {
+			userError(err.Error())
+		}
+		t.Duration = info.Duration()
+		if s, ok := info.Stream("audio"); ok {
+			t.Codec = s.CodecName
+		}
+	}
+
+	// The mix is credited as a single track with every artist
+	mix := &Track{Title: name}
+	for _, t := range tracks {
+		appendUnique(&mix.Artists, t.Artists...)
+	}
+	updateArtists(c, mix.Artists...)
+
+	job := RenderJob{}
+	if len(tracks) == 1 {
+		chapters = trackChapters(tracks[0])
+		job.Duration = tracks[0].Trim.Length(tracks[0].Duration)
+		job.AudioCodec = tracks[0].Codec
+		job.Trim = tracks[0].Trim
+		if err := checkChapters(chapters, job.Duration); err != nil {
+			userError(err.Error())
+		}
+	} else {
+		chapters, job.Duration, err = mixChapters(tracks, self.Options.Crossfade)
+		if err != nil {
+			userError(err.Error())
+		}
+		for _, t := range tracks {
+			job.Segments = append(job.Segments, Segment{t.Path, t.Trim, t.Duration})
+		}
+		job.Crossfade = self.Options.Crossfade
+	}
+
+	start, ok := latestScheduledTime(c)
+	now := time.Now()
+	if !ok {
+		start = now
+	}
+	publishAt := self.Schedule.publishTime(start, 1, now)
+
+	build := VideoBuilder{
+		Track:     mix,
+		Art:       art,
+		Format:    &self.Schedule.Format,
+		Extension: editor.FileFormat,
+		Tracks:    tracks,
+		Chapters:  chapters,
+		PublishAt: &publishAt,
+	}
+	vid, err := build.Video(c, self.DataDir)
+	if err != nil {
+		userError(err.Error())
+	}
+	job.Tags, err = build.Tags()
+	if err != nil {
+		userError(err.Error())
+	}
+	vid.Profile = self.Options.Profile
+
+	job.Video = vid
+	job.Template = build.Template()
+	job.LogPath = self.Schedule.logPath(vid)
+	tasks := []renderTask{{editor: editor, profile: profile, art: art, job: job}}
+	self.Schedule.renderVideos(ctx, tasks)
+
+	if err := tasks[0].err; err != nil {
+		if err != context.Canceled {
+			printError("render: %s\n%v", vid.Title, err)
+		}
+		var verifyErr *VerifyError
+		if errors.As(err, &verifyErr) {
+			vid.State = Failed
+			vid.Error = verifyErr.Reason
+			c.Schedule = append(c.Schedule, vid)
+		}
+		return
+	}
+	for _, t := range tracks {
+		t.State = Scheduled
+	}
+	for _, a := range art {
+		a.State = Scheduled
+	}
+	vid.RenderKey = tasks[0].job.Cache.Key
+	vid.State = Scheduled
+	c.Schedule = append(c.Schedule, vid)
+	userLog("schedule:", "%s (%d chapters)", vid.Title, len(chapters))
+}
+
+// Add the audio file of a cue sheet as a track with a chapter for each
+// track of the sheet.
+func (self *MixCommand) addCueTrack(c *Collections) (*Track, *CueSheet) {
+	sheet, err := ReadCueSheet(self.Options.Cue)
+	if err != nil {
+		userError(err.Error())
+	}
+
+	opt := AddOptions{
+		Name:   sheet.Title,
+		By:     sheet.Performer,
+		Artist: strings.Join(sheet.Artists(), ","),
+	}
+	dst := path.Join(self.DataDir, "music")
+	os.MkdirAll(dst, os.ModePerm)
+	track, err := NewTrack(sheet.File, dst, opt)
+	if err != nil {
+		userError(Err_CreateResource, "music")
+	}
+	track.Chapters = sheet.Tracks
+	AddTrack(c, *track)
+
+	added, _ := c.Find(track.UniqueId())
+	return added.(*Track), sheet
+}
+
+// Buffered artwork in a set in the order it was added, or the most
+// recently added artwork when set is empty.
+func mixArtwork(c *Collections, set string) []*Artwork {
+	var art []*Artwork
+	for i := len(c.Artwork) - 1; i >= 0; i-- {
+		a := c.Artwork[i]
+		if a.State != Buffered {
+			continue
+		}
+		if set == "" {
+			return []*Artwork{a}
+		}
+		if a.Set == set {
+			art = append([]*Artwork{a}, art...)
+		}
+	}
+	return art
+}
+
+// Chapters of a single track shifted by its trim, chapters cut by the
+// trim are dropped except the one playing at the start. The first
+// chapter starts at 0 such that a pregap plays as part of it.
+func trackChapters(track *Track) []Chapter {
+	var chapters []Chapter
+	for _, ch := range track.Chapters {
+		ch.Start -= track.Trim.Start
+		if track.Trim.End > 0 && ch.Start >= track.Trim.Length(track.Duration) {
+			break
+		}
+		if ch.Start <= 0 {
+			ch.Start = 0
+			chapters = chapters[:0]
+		}
+		chapters = append(chapters, ch)
+	}
+	if len(chapters) > 0 {
+		chapters[0].Start = 0
+	}
+	return chapters
+}
+
+// Chapters of a mix starting when each track starts fading in, returns
+// the duration of the mix.
+func mixChapters(tracks []*Track, crossfade float64) ([]Chapter, float64, error) {
+	chapters := make([]Chapter, len(tracks))
+	start := 0.0
+	for i, t := range tracks {
+		length := t.Trim.Length(t.Duration)
+		if length <= 0 {
+			return nil, 0, fmt.Errorf(Err_UnknownDuration, "a mix")
+		}
+		if crossfade > 0 && crossfade >= length {
+			return nil, 0, fmt.Errorf(Err_MixLength, crossfade, length)
+		}
+		chapters[i] = Chapter{start, t.Title, t.By}
+		start += length
+		if i < len(tracks)-1 {
+			start -= math.Max(crossfade, 0)
+		}
+	}
+	if err := checkChapters(chapters, start); err != nil {
+		return nil, 0, err
+	}
+	return chapters, start, nil
+}
+
+// Check that chapters of a video of the given duration are shown by
+// YouTube, the first chapter must start at 0.
+func checkChapters(chapters []Chapter, duration float64) error {
+	if len(chapters) < minChapters {
+		return fmt.Errorf(Err_ChapterCount, minChapters, len(chapters))
+	}
+	if chapters[0].Start != 0 {
+		return fmt.Errorf(Err_ChapterStart, chapters[0].Title, chapterTime(chapters[0].Start))
+	}
+	for i, ch := range chapters {
+		end := duration
+		if i < len(chapters)-1 {
+			end = chapters[i+1].Start
+		}
+		if end-ch.Start < minChapterLength {
+			return fmt.Errorf(Err_ChapterTooShort, ch.Title, end-ch.Start, float64(minChapterLength))
+		}
+	}
+	return nil
+}
+
+// Format a chapter start the way YouTube expects it, m:ss or h:mm:ss
+func chapterTime(seconds float64) string {
+	s := int(seconds)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// Join the tracks of a mix, the first track is input 1 and the other
+// tracks are added as inputs. Each track is trimmed and faded before
+// being joined with a crossfade or one after another.
+func (self *Editor) applyMix(g *filterGraph, segments []Segment, crossfade float64) error {
+	streams := make([]string, len(segments))
+	for i, s := range segments {
+		if i > 0 {
+			g.audio = inputStream(g.Input("-i", s.Path), "a")
+		}
+		if err := s.Trim.apply(g); err != nil {
+			return err
+		}
+		if err := s.Trim.applyFades(g, s.Trim.Length(s.Duration)); err != nil {
+			return err
+		}
+		// Tracks from different sources must share a format to be joined
+		g.AudioFilter("aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo")
+		streams[i] = g.audio
+	}
+
+	if crossfade > 0 {
+		g.audio = streams[0]
+		for _, s := range streams[1:] {
+			g.audio = g.Add(fmt.Sprintf("acrossfade=d=%g", crossfade), g.audio, s)
+		}
+		return nil
+	}
+	g.audio = g.Add(fmt.Sprintf("concat=n=%d:v=0:a=1", len(streams)), streams...)
+	return nil
+}
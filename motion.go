@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	Err_InvalidMotion = "Motion preset '%s' is not valid (expected zoom-in, zoom-out, pan or drift)."
+	Err_InvalidFocus  = "Focus point '%s' is not valid (expected x,y between 0 and 1)."
+)
+
+const (
+	MotionNone = ""
+	// Disable motion set by the render profile
+	MotionOff     = "none"
+	MotionZoomIn  = "zoom-in"
+	MotionZoomOut = "zoom-out"
+	// Pan from left to right
+	MotionPan = "pan"
+	// Slowly wander around the artwork
+	MotionDrift = "drift"
+)
+
+// Slow zoom or pan over still artwork. Speed scales how fast the motion
+// completes, at 1 zooms and pans take the whole video and a drift cycle
+// takes a minute. Focus is the x,y point zooms are centered on, as a
+// fraction of the image size. Videos longer than MaxDuration seconds are
+// rendered as a still. A frame rate set with -r in OutputArgs is ignored
+// when artwork is in motion.
+type Motion struct {
+	Preset      string
+	Speed       float64
+	Focus       string
+	MaxDuration float64
+}
+
+// Motion settings of an artwork with unset fields taken from defaults
+func (self Motion) Merge(defaults Motion) Motion {
+	if self.Preset == MotionNone {
+		self.Preset = defaults.Preset
+	}
+	if self.Speed <= 0 {
+		self.Speed = defaults.Speed
+	}
+	if self.Focus == "" {
+		self.Focus = defaults.Focus
+	}
+	if self.MaxDuration <= 0 {
+		self.MaxDuration = defaults.MaxDuration
+	}
+	return self
+}
+
+func (self *Motion) enabled(duration float64) bool {
+	if self.Preset == MotionNone || self.Preset == MotionOff {
+		return false
+	}
+	return self.MaxDuration <= 0 || duration <= self.MaxDuration
+}
+
+// Build a zoompan chain producing a w by h stream at rate frames per
+// second from a still image shown for duration seconds.
+func (self *Motion) filter(w, h, rate int, duration float64) (string, error) {
+	fx, fy, err := parseFocus(self.Focus)
+	if err != nil {
+		return "", err
+	}
+	speed := self.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	frames := duration * float64(rate)
+	if frames <= 0 {
+		frames = 60 * float64(rate)
+	}
+	// Progress of the motion from 0 to 1
+	p := fmt.Sprintf("min(on*%g/%g,1)", speed, frames)
+	// Offset centering the zoomed window on the focus point
+	focusX := fmt.Sprintf("clip(iw*%g-iw/zoom/2,0,iw-iw/zoom)", fx)
+	focusY := fmt.Sprintf("clip(ih*%g-ih/zoom/2,0,ih-ih/zoom)", fy)
+
+	var z, x, y string
+	switch self.Preset {
+	case MotionZoomIn:
+		z = "1+0.3*" + p
+		x, y = focusX, focusY
+	case MotionZoomOut:
+		z = "1.3-0.3*" + p
+		x, y = focusX, focusY
+	case MotionPan:
+		z = "1.2"
+		x = "(iw-iw/zoom)*" + p
+		y = focusY
+	case MotionDrift:
+		period := 60 * float64(rate) / speed
+		z = "1.1"
+		x = fmt.Sprintf("(iw-iw/zoom)*(0.5+0.5*sin(2*PI*on/%g))", period)
+		y = fmt.Sprintf("(ih-ih/zoom)*(0.5+0.5*cos(2*PI*on/%g))", period*1.3)
+	default:
+		return "", fmt.Errorf(Err_InvalidMotion, self.Preset)
+	}
+
+	// Upscaling first reduces the jitter zoompan has from rounding the
+	// window position to whole pixels.
+	return fmt.Sprintf("fps=%d,scale=%d:%d,zoompan=z='%s':x='%s':y='%s':d=1:s=%dx%d:fps=%d,setsar=1",
+		rate, w*2, h*2, z, x, y, w, h, rate), nil
+}
+
+func parseFocus(s string) (float64, float64, error) {
+	if s == "" {
+		return 0.5, 0.5, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf(Err_InvalidFocus, s)
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errX != nil || errY != nil || x < 0 || x > 1 || y < 0 || y > 1 {
+		return 0, 0, fmt.Errorf(Err_InvalidFocus, s)
+	}
+	return x, y, nil
+}
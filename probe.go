@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type MediaInfo struct {
+	Streams []StreamInfo `json:"streams"`
+	Format  FormatInfo   `json:"format"`
+}
+
+type StreamInfo struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Duration  string `json:"duration"`
+	// Frame count and rate of video streams, nb_frames is not stored
+	// by every container.
+	NbFrames     string `json:"nb_frames"`
+	AvgFrameRate string `json:"avg_frame_rate"`
+}
+
+type FormatInfo struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+}
+
+// Read stream and container information from a media file using ffprobe
+func (self *Editor) Probe(path string) (*MediaInfo, error) {
+	cmd := exec.Command(
+		self.probePath(),
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: failed to read '%s' (%v)", path, err)
+	}
+
+	info := new(MediaInfo)
+	if err := json.Unmarshal(out, info); err != nil {
+		return nil, fmt.Errorf("ffprobe: %v", err)
+	}
+	return info, nil
+}
+
+// Duration of the media file in seconds, zero if unknown
+func (self *MediaInfo) Duration() float64 {
+	d, err := strconv.ParseFloat(self.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Find the first stream of a given type (audio, video, subtitle...)
+func (self *MediaInfo) Stream(codecType string) (*StreamInfo, bool) {
+	for i := range self.Streams {
+		if self.Streams[i].CodecType == codecType {
+			return &self.Streams[i], true
+		}
+	}
+	return nil, false
+}
+
+func (self *Editor) probePath() string {
+	if self.ProbePath != "" {
+		return self.ProbePath
+	}
+	// Assume ffprobe lives next to the ffmpeg binary, this way a full
+	// path to ffmpeg in config.json also works for ffprobe.
+	dir, file := filepath.Split(self.Path)
+	if strings.HasPrefix(file, "ffmpeg") {
+		return dir + "ffprobe" + strings.TrimPrefix(file, "ffmpeg")
+	}
+	return "ffprobe"
+}
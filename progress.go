@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TaskWaiting = iota
+	TaskRunning
+	TaskDone
+	TaskFailed
+)
+
+// A progressBoard displays the state of several tasks running at the
+// same time, one line per task. Lines are redrawn in place on terminals
+// that support it, on Windows a line is printed when a task finishes.
+type progressBoard struct {
+	mu     sync.Mutex
+	mod    string
+	labels []string
+	state  []int
+	status []string
+	frame  int
+	drawn  int
+	stop   chan bool
+	done   chan bool
+}
+
+func newProgressBoard(mod string, labels []string) *progressBoard {
+	return &progressBoard{
+		mod:    mod,
+		labels: labels,
+		state:  make([]int, len(labels)),
+		status: make([]string, len(labels)),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+}
+
+// Start redrawing the board until Stop is called
+func (self *progressBoard) Start() {
+	go func() {
+		for {
+			select {
+			case <-self.stop:
+				self.mu.Lock()
+				self.draw()
+				self.mu.Unlock()
+				self.done <- true
+				return
+			default:
+				time.Sleep(60 * time.Millisecond)
+				self.mu.Lock()
+				self.frame++
+				self.draw()
+				self.mu.Unlock()
+			}
+		}
+	}()
+}
+
+func (self *progressBoard) Stop() {
+	self.stop <- true
+	<-self.done
+}
+
+// Update the state of task i, status is an optional message shown
+// after the task label.
+func (self *progressBoard) Update(i, state int, status string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.state[i] = state
+	self.status[i] = status
+
+	if runtime.GOOS == "windows" && state >= TaskDone {
+		userLog(self.mod, "%s", self.line(i))
+	}
+}
+
+func (self *progressBoard) draw() {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	var b strings.Builder
+	if self.drawn > 0 {
+		// Move cursor back to the first line of the board
+		fmt.Fprintf(&b, "\033[%dA", self.drawn)
+	}
+	for i := range self.labels {
+		mod := fmt.Sprintf("\033[0;36;1m%s\033[0m", self.mod)
+		fmt.Fprintf(&b, "\r\033[K%s %s\n", mod, self.line(i))
+	}
+	self.drawn = len(self.labels)
+	fmt.Print(b.String())
+}
+
+func (self *progressBoard) line(i int) string {
+	progress := [...]byte{'|', '/', '-', '|', '-', '\\'}
+	label := fmt.Sprintf("[%d/%d] %s", i+1, len(self.labels), self.labels[i])
+
+	var line string
+	switch self.state[i] {
+	case TaskWaiting:
+		line = label
+	case TaskRunning:
+		tok := progress[self.frame%len(progress)]
+		line = fmt.Sprintf("%s %c %s", label, tok, self.status[i])
+	case TaskDone:
+		line = fmt.Sprintf("%s done %s", label, self.status[i])
+	default:
+		line = fmt.Sprintf("%s failed %s", label, self.status[i])
+	}
+	return strings.TrimSpace(line)
+}
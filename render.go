@@ -1,37 +1,148 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
+	"time"
 )
 
 type Template map[string]string
 
+// Editor describes how ffmpeg is invoked to render a video. Args, when
+// set, is a full ffmpeg command line, otherwise the command line is
+// built from InputArgs and OutputArgs with the image and audio inputs in
+// between. Arguments are split like shell words and may contain the
+// placeholders %(image), %(audio), %(output), %(title) and %(duration).
+// %(acodec) expands to the audio codec arguments chosen for the track,
+// see AudioCodec.
+// The filter graph generated for visualizers and other effects is
+// available as %(filter), with the streams to map as %(vout) and %(aout)
+// and any extra inputs it reads from as %(inputs). When the graph sets
+// the frame rate, as visualizers, slideshows and motion do, -r is left
+// out of OutputArgs.
+//
+// When Fit is set, artwork is scaled to the Canvas size (WxH) before
+// rendering using one of the pad, blur or crop modes.
+//
+// Animated artwork is rendered with LoopInputArgs and LoopOutputArgs in
+// place of InputArgs and OutputArgs, at the frame rate of the animation.
+//
+// When Metadata is enabled the title, artists and description of the
+// video are written into the rendered file, see Metadata.
 type Editor struct {
 	Path       string
+	ProbePath  string
+	Args       string
 	InputArgs  string
 	OutputArgs string
+	// Arguments used when the artwork is animated
+	LoopInputArgs  string
+	LoopOutputArgs string
+	// Codec (aac or opus) and bitrate audio is transcoded to when the
+	// track cannot be copied as is.
+	AudioCodec   string
+	AudioBitrate string
+	Loudness     Loudness
+	// Silence cut by silence detection when music is added
+	Silence    Silence
 	FileFormat string
+	Canvas     string
+	Fit        string
+	PadColor   string
+	Visualizer Visualizer
+	Text       []TextLayer
+	// Frame rate of generated video such as slideshows, defaults to 25
+	FrameRate int
+	// Duration of the crossfade between slideshow images in seconds
+	SlideCrossfade float64
+	// Default motion for artwork, disabled when Preset is empty
+	Motion Motion
+	// Overrides the global branding when set
+	Branding *Branding
+	// Extra outputs rendered next to each video
+	Variants []Variant
+	// Metadata written into and checks run on rendered files, profiles
+	// without their own use those of the Ffmpeg editor. Both are
+	// disabled when not set.
+	Metadata *Metadata
+	Verify   *Verify
 }
 
 type VideoFormat struct {
-	Title          string
-	Header         string
+	Title  string
+	Header string
+	// Title and header of mixes, with a line for each chapter of the
+	// video added after the header.
+	MixTitle string
+	Chapter  string
+	// Title of shorts cut from a video
+	ShortTitle string
+	// Path of rendered videos in the schedule directory, see
+	// VideoBuilder.FileName
+	FileName string
+	// Album tag written into rendered files, such as the channel name
+	Album          string
 	ArtworkCredits string
 	TrackCredits   string
 	Link           string
 	Footer         string
 }
 
+type RenderJob struct {
+	Video *Video
+	// Images rendered in place of Video.Image when set, more than one
+	// image renders a slideshow.
+	Slides []Slide
+	// Path rendered to in place of Video.Path when set
+	Output string
+	// Duration of the trimmed audio and its codec, probed when not set
+	Duration   float64
+	AudioCodec string
+	Trim       Trim
+	// Tracks of a mix joined in place of Video.Audio, with a crossfade
+	// in seconds between them.
+	Segments  []Segment
+	Crossfade float64
+	// Loudness of the audio, measured when normalization is enabled
+	Loudness *LoudnessInfo
+	// Values for templates used in text overlays
+	Template Template
+	// Metadata tags written into the rendered file
+	Tags     Template
+	Cache    RenderCache
+	LogPath  string
+	Progress func(RenderStatus) `json:"-"`
+}
+
+type Slide struct {
+	Image string
+	// Seconds the image is shown, zero to split the remaining time
+	// evenly between slides.
+	Duration float64
+	Motion   Motion
+	// Frame rate of an animated image looped for its duration, zero
+	// for a still image.
+	Rate float64
+}
+
 type VideoBuilder struct {
 	Track     *Track
-	Art       *Artwork
+	Art       []*Artwork
 	Format    *VideoFormat
 	Extension string
+	// Tracks of a mix, Track is then the mix credited with every artist
+	Tracks   []*Track
+	Chapters []Chapter
+	// Publish time of the video, and paths taken by videos that have
+	// not been added to the collections yet.
+	PublishAt *time.Time
+	Taken     map[string]bool
+	// Only plan the video, the schedule directory is not created
+	DryRun bool
 }
 
 type templateGen struct {
@@ -39,25 +150,208 @@ type templateGen struct {
 	b *strings.Builder
 }
 
-// Render video by merging audio from track and artwork image
-func (self *Editor) Render(video *Video) error {
-	args := strings.Split(self.InputArgs, " ")
-	args = append(args, "-i", video.Image, "-i", video.Audio)
-	args = append(args, strings.Split(self.OutputArgs, " ")...)
-	args = append(args, video.Path)
-	cmd := exec.Command(self.Path, args...)
+// Render video by merging audio from track and artwork image. The
+// partially written output is removed if rendering fails or ctx is
+// cancelled, a rendered video failing verification returns a
+// VerifyError.
+func (self *Editor) Render(ctx context.Context, job *RenderJob) error {
+	if done, err := self.RestoreRender(ctx, job); done || err != nil {
+		return err
+	}
 
-	stop := make(chan bool)
-	go userProgress(stop, "render:", "%s", video.Title)
+	dst := job.Video.Path
+	if self.Branding.hasBumpers() {
+		// Render to a temporary file which is joined with the intro
+		// and outro clips.
+		job.Output = bumperTempPath(dst)
+		defer os.Remove(job.Output)
+	}
 
-	err := cmd.Start()
+	args, err := self.Command(job)
+	if err != nil {
+		return err
+	}
+	err = runFfmpeg(ctx, self.Path, args, job.Duration, job.LogPath, job.Progress)
+	if err == nil && self.Branding.hasBumpers() {
+		err = self.addBumpers(ctx, job, job.Output, dst)
+	}
 	if err != nil {
+		os.Remove(dst)
 		return err
 	}
-	err = cmd.Wait()
-	stop <- true
-	userLogRepl("render:", "%s  \n", video.Title)
-	return err
+	return self.FinishRender(ctx, job)
+}
+
+// Probe and measure the audio of a job and restore the video from the
+// render cache, returns true when the video was restored. The cached
+// video was verified when it was rendered.
+func (self *Editor) RestoreRender(ctx context.Context, job *RenderJob) (bool, error) {
+	if job.Duration == 0 || job.AudioCodec == "" {
+		// Without a duration progress is still reported but without
+		// a percentage or ETA, an unknown codec is transcoded.
+		if info, err := self.Probe(job.Video.Audio); err == nil {
+			job.Duration = job.Trim.Length(info.Duration())
+			if s, ok := info.Stream("audio"); ok {
+				job.AudioCodec = s.CodecName
+			}
+		}
+	}
+
+	// Mixes are normalized in a single pass
+	if self.Loudness.Enabled && job.Loudness == nil && len(job.Segments) == 0 {
+		info, err := self.MeasureLoudness(ctx, job.Video.Audio, job.Trim)
+		if err != nil {
+			return false, err
+		}
+		job.Loudness = info
+	}
+
+	if job.Cache.Dir == "" {
+		return false, nil
+	}
+	key, err := self.cacheKey(job)
+	if err != nil {
+		return false, err
+	}
+	job.Cache.Key = key
+	dst := job.Video.Path
+	if job.Cache.Force || !job.Cache.restore(dst) {
+		return false, nil
+	}
+	if self.Metadata == nil || !self.Metadata.Enabled {
+		return true, nil
+	}
+	if err := self.writeTags(ctx, job, dst); err != nil {
+		os.Remove(dst)
+		return true, err
+	}
+	return true, nil
+}
+
+// Add a rendered video to the render cache, then write its tags and
+// verify it. Videos failing verification are kept to be inspected.
+func (self *Editor) FinishRender(ctx context.Context, job *RenderJob) error {
+	dst := job.Video.Path
+	var part string
+	if job.Cache.Key != "" {
+		// Cache the video without tags, which change when a video is
+		// scheduled again.
+		part = job.Cache.keep(dst)
+		defer os.Remove(part)
+	}
+	if self.Metadata != nil && self.Metadata.Enabled {
+		if err := self.writeTags(ctx, job, dst); err != nil {
+			os.Remove(dst)
+			return err
+		}
+	}
+	if self.Verify != nil && self.Verify.Enabled {
+		if err := self.VerifyRender(job, dst); err != nil {
+			return err
+		}
+	}
+	if part != "" {
+		job.Cache.commit(part)
+	}
+	return nil
+}
+
+// Build the ffmpeg arguments used to render a video
+func (self *Editor) Command(job *RenderJob) ([]string, error) {
+	video := job.Video
+	graph, err := self.filters(job)
+	if err != nil {
+		return nil, err
+	}
+
+	format := self.Args
+	if format == "" {
+		var filter string
+		if !graph.Empty() {
+			filter = "-filter_complex %(filter) -map %(vout) -map %(aout)"
+		}
+		inputArgs, outputArgs := self.InputArgs, self.OutputArgs
+		if len(job.Slides) > 0 && job.Slides[0].Rate > 0 {
+			inputArgs, outputArgs = self.LoopInputArgs, self.LoopOutputArgs
+		}
+		// The audio codec is chosen by %(acodec), older configs copy
+		// audio in their output args which would override it.
+		codecArgs := []string{"-acodec", "-c:a", "-codec:a"}
+		if graph.rate > 0 {
+			// A lower output frame rate would drop animated frames
+			codecArgs = append(codecArgs, "-r")
+		}
+		if outputArgs, err = removeArg(outputArgs, codecArgs...); err != nil {
+			return nil, err
+		}
+		format = fmt.Sprintf(
+			"%s -i %%(image) -i %%(audio) %%(inputs) %s %%(acodec) %s %%(output)",
+			inputArgs,
+			filter,
+			outputArgs)
+	}
+
+	words, err := splitArgs(format)
+	if err != nil {
+		return nil, err
+	}
+
+	image := video.Image
+	if len(job.Slides) > 0 {
+		image = job.Slides[0].Image
+	}
+	output := video.Path
+	if job.Output != "" {
+		output = job.Output
+	}
+
+	template := Template{
+		"image":  image,
+		"audio":  video.Audio,
+		"output": output,
+		"title":  video.Title,
+		"filter": graph.String(),
+		"vout":   mapStream(graph.video),
+		"aout":   mapStream(graph.audio),
+	}
+
+	// Only probe the audio file when the duration is actually used
+	if strings.Contains(format, "%(duration)") {
+		if job.Duration == 0 {
+			info, err := self.Probe(video.Audio)
+			if err != nil {
+				return nil, err
+			}
+			job.Duration = job.Trim.Length(info.Duration())
+		}
+		template["duration"] = fmt.Sprintf("%.3f", job.Duration)
+	}
+
+	// Audio that went through a filter has to be encoded again
+	acodec, err := self.audioArgs(job.AudioCodec, graph.audio != "1:a")
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, len(words))
+	for _, w := range words {
+		// Inputs added by filters and audio codec arguments expand to
+		// several arguments.
+		if w == "%(inputs)" {
+			args = append(args, graph.inputs...)
+			continue
+		}
+		if w == "%(acodec)" {
+			args = append(args, acodec...)
+			continue
+		}
+		arg, err := buildTemplate(w, template)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
 }
 
 func (self *VideoBuilder) Video(c *Collections, dst string) (*Video, error) {
@@ -71,30 +365,73 @@ func (self *VideoBuilder) Video(c *Collections, dst string) (*Video, error) {
 		return nil, err
 	}
 
-	if dst != "" {
+	name, err := self.FileName()
+	if err != nil {
+		return nil, err
+	}
+	// Without a data directory the video is only previewed
+	preview := dst == ""
+	if !preview {
 		dst = path.Join(dst, "schedule")
-		os.MkdirAll(dst, os.ModePerm)
+	}
+	dst = uniqueVideoPath(c, self.Taken, path.Join(dst, name), self.Extension)
+	if !preview && !self.DryRun {
+		os.MkdirAll(path.Dir(dst), os.ModePerm)
 	}
 
-	filename := title + self.Extension
-	dst = path.Join(dst, filename)
+	var images []string
+	if len(self.Art) > 1 {
+		for _, a := range self.Art {
+			images = append(images, a.UniqueId())
+		}
+	}
+
+	audio := self.Track.UniqueId()
+	var tracks []string
+	if len(self.Tracks) > 0 {
+		audio = self.Tracks[0].UniqueId()
+	}
+	if len(self.Tracks) > 1 {
+		for _, t := range self.Tracks {
+			tracks = append(tracks, t.UniqueId())
+		}
+	}
 
 	return &Video{
 		Title:       title,
 		Description: desc,
 		Path:        dst,
 		State:       Buffered,
-		PublishAt:   nil,
-		Audio:       self.Track.UniqueId(),
-		Image:       self.Art.UniqueId(),
+		PublishAt:   self.PublishAt,
+		Audio:       audio,
+		Image:       self.Art[0].UniqueId(),
+		Images:      images,
+		Tracks:      tracks,
 	}, nil
 }
 
 func (self *VideoBuilder) Title() (string, error) {
-	return buildTemplate(
-		self.Format.Title,
-		Template{"by": self.Track.By, "title": self.Track.Title},
-	)
+	if len(self.Tracks) > 0 {
+		return buildTemplate(self.mixTitle(), self.Template())
+	}
+	return buildTemplate(self.Format.Title, self.Template())
+}
+
+// Title format of mixes, configs written before mixes have none
+func (self *VideoBuilder) mixTitle() string {
+	if self.Format.MixTitle == "" {
+		return defaultConfig.VideoFormat.MixTitle
+	}
+	return self.Format.MixTitle
+}
+
+// Values available to title, header and text overlay templates
+func (self *VideoBuilder) Template() Template {
+	return Template{
+		"by":      self.Track.By,
+		"title":   self.Track.Title,
+		"artists": strings.Join(self.Track.Artists, ", "),
+	}
 }
 
 func (self *VideoBuilder) Desc(c *Collections) (string, error) {
@@ -106,6 +443,11 @@ func (self *VideoBuilder) Desc(c *Collections) (string, error) {
 		return "", err
 	}
 
+	err = self.writeChapters(gen)
+	if err != nil {
+		return "", err
+	}
+
 	if self.Track.Description != "" {
 		b.WriteString(self.Track.Description)
 		b.WriteString("\n\n")
@@ -129,11 +471,12 @@ func (self *VideoBuilder) Desc(c *Collections) (string, error) {
 }
 
 func (self *VideoBuilder) writeHeader(gen templateGen) error {
-	if self.Format.Header != "" {
-		header, err := buildTemplate(
-			self.Format.Header,
-			Template{"by": self.Track.By, "title": self.Track.Title},
-		)
+	format := self.Format.Header
+	if len(self.Tracks) > 0 {
+		format = self.mixTitle()
+	}
+	if format != "" {
+		header, err := buildTemplate(format, self.Template())
 		if err != nil {
 			return err
 		}
@@ -143,6 +486,31 @@ func (self *VideoBuilder) writeHeader(gen templateGen) error {
 	return nil
 }
 
+func (self *VideoBuilder) writeChapters(gen templateGen) error {
+	if len(self.Chapters) == 0 {
+		return nil
+	}
+	// Configs written before chapters have no chapter format
+	format := self.Format.Chapter
+	if format == "" {
+		format = defaultConfig.VideoFormat.Chapter
+	}
+	for _, ch := range self.Chapters {
+		line, err := buildTemplate(format, Template{
+			"time":  chapterTime(ch.Start),
+			"title": ch.Title,
+			"by":    ch.By,
+		})
+		if err != nil {
+			return err
+		}
+		gen.b.WriteString(line)
+		gen.b.WriteByte('\n')
+	}
+	gen.b.WriteByte('\n')
+	return nil
+}
+
 func (self *VideoBuilder) writeLinks(gen templateGen, id string) error {
 	col, ok := gen.c.Find(strings.ToLower(id))
 	if !ok {
@@ -185,17 +553,29 @@ func (self *VideoBuilder) writeTrackCredits(gen templateGen) error {
 }
 
 func (self *VideoBuilder) writeArtCredits(gen templateGen) error {
-	credits, err := buildTemplate(
-		self.Format.ArtworkCredits,
-		Template{"artist": self.Art.Artist},
-	)
-	if err != nil {
-		return err
+	var artists []string
+	for _, a := range self.Art {
+		appendUnique(&artists, a.Artist)
 	}
-	gen.b.WriteString(credits)
-	gen.b.WriteByte('\n')
 
-	err = self.writeLinks(gen, self.Art.Artist)
+	for i, a := range artists {
+		if i > 0 {
+			gen.b.WriteByte('\n')
+		}
+		credits, err := buildTemplate(
+			self.Format.ArtworkCredits,
+			Template{"artist": a},
+		)
+		if err != nil {
+			return err
+		}
+		gen.b.WriteString(credits)
+		gen.b.WriteByte('\n')
+
+		if err = self.writeLinks(gen, a); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -216,7 +596,12 @@ func buildTemplate(format string, template Template) (string, error) {
 
 		if next(i, &tokB) && tokA == '%' && tokB == '(' {
 			i += 2
-			end := strings.IndexByte(format[i:], ')') + i
+			end := strings.IndexByte(format[i:], ')')
+			if end < 0 {
+				err := fmt.Sprintf("unterminated key in '%s'", format)
+				return format, errors.New(err)
+			}
+			end += i
 			key := format[i:end]
 
 			val, ok := template[key]
@@ -233,3 +618,101 @@ func buildTemplate(format string, template Template) (string, error) {
 	}
 	return b.String(), nil
 }
+
+// Split a command line into words the way a POSIX shell would, words
+// are separated by whitespace and may be grouped with single or double
+// quotes. A backslash escapes the next character outside of quotes and
+// a double quote or backslash inside double quotes.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	inWord := false
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+				continue
+			}
+			b.WriteByte(c)
+
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+				continue
+			}
+			if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+				c = s[i]
+			}
+			b.WriteByte(c)
+
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+			inWord = true
+
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				args = append(args, b.String())
+				b.Reset()
+				inWord = false
+			}
+
+		default:
+			b.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in '%s'", s)
+	}
+	if inWord {
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// Quote arguments such that splitArgs splits them into the same words
+func quoteArgs(args []string) string {
+	words := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`;&|<>()[]*?!#") {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		words[i] = a
+	}
+	return strings.Join(words, " ")
+}
+
+// Remove options and their values from a command line
+func removeArg(s string, names ...string) (string, error) {
+	args, err := splitArgs(s)
+	if err != nil {
+		return "", err
+	}
+	remove := make(map[string]bool)
+	for _, n := range names {
+		remove[n] = true
+	}
+	kept := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if remove[args[i]] {
+			i++
+			continue
+		}
+		kept = append(kept, args[i])
+	}
+	return quoteArgs(kept), nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,30 +20,66 @@ const (
 	Err_InvalidUploadTime = "Upload time %s is not valid (expected hh:ss:mm)."
 )
 
+// Buffered tracks paired with the artwork shown in their videos, most
+// recent first. Each video shows one artwork or a set of artwork.
 type Schedule struct {
 	Tracks  []*Track
-	Artwork []*Artwork
+	Artwork [][]*Artwork
 	Count   int
 }
 
 type ScheduleOptions struct {
-	Short bool `opt:"-s"`
+	Short   bool   `opt:"-s"`
+	Profile string `opt:"-p"`
+	Jobs    int    `opt:"-j"`
+	Shorts  bool   `opt:"--shorts"`
+	Force   bool   `opt:"--force-render"`
+}
+
+// Render profile a task is rendered with, workers build the editor of a
+// task from their own profiles. Shorts use the Shorts settings and
+// variants the variant of that name declared by the profile.
+type RenderProfile struct {
+	Name       string
+	Visualizer string
+	Short      bool
+	Variant    string
+}
+
+// A video waiting to be rendered by an editor
+type renderTask struct {
+	editor  Editor
+	profile RenderProfile
+	track   *Track
+	art     []*Artwork
+	job     RenderJob
+	err     error
+	// Shorts and variants follow the task of the video they were
+	// rendered from.
+	short   bool
+	variant string
 }
 
 type ScheduleCommand struct {
 	DataDir         string
 	Function        string
-	Editor          Editor
+	Profile         func(name string) (Editor, error)
+	RenderTimeout   time.Duration
 	Format          VideoFormat
 	UploadFrequency int
 	UploadTimeUTC   string
-	Options         ScheduleOptions
+	Shorts          Shorts
+	// Videos are also dispatched to these workers
+	Workers []RemoteWorker
+	// Print the videos that would be rendered without rendering them
+	DryRun  bool
+	Options ScheduleOptions
 }
 
 // Try to schedule a videos by finding a suitable track and artwork
 func NewSchedule(c *Collections) (Schedule, error) {
 	tracks := []*Track{}
-	artwork := []*Artwork{}
+	artwork := [][]*Artwork{}
 
 	for i := len(c.Tracks) - 1; i >= 0; i-- {
 		t := c.Tracks[i]
@@ -53,41 +93,72 @@ func NewSchedule(c *Collections) (Schedule, error) {
 
 	for i := len(c.Artwork) - 1; i >= 0; i-- {
 		a := c.Artwork[i]
-		if a.State == Buffered {
-			artwork = append(artwork, a)
+		if a.State != Buffered {
+			continue
+		}
+		// Consecutive artwork in the same set is grouped in one video
+		if n := len(artwork); n > 0 && a.Set != "" && artwork[n-1][0].Set == a.Set {
+			artwork[n-1] = append(artwork[n-1], a)
+			continue
 		}
+		artwork = append(artwork, []*Artwork{a})
 	}
 	if len(artwork) == 0 {
 		return Schedule{}, errors.New(Err_NoBufferedArtwork)
 	}
 
+	// Sets were collected most recent first, slides are shown in the
+	// order they were added.
+	for _, set := range artwork {
+		for i, j := 0, len(set)-1; i < j; i, j = i+1, j-1 {
+			set[i], set[j] = set[j], set[i]
+		}
+	}
+
 	count := int(math.Min(float64(len(tracks)), float64(len(artwork))))
 	return Schedule{tracks[:count], artwork[:count], count}, nil
 }
 
-func (self *ScheduleCommand) Exec(c *Collections) {
+func (self *ScheduleCommand) Exec(ctx context.Context, c *Collections) {
 	switch self.Function {
 	case "undo":
 		if len(c.Schedule) == 0 {
 			userError(Err_EmptySchedule)
 		}
 
-		vid := c.Schedule[len(c.Schedule)-1]
-		if vid.State == Published {
-			userError(Err_PublishedVideo)
+		// Shorts are scheduled right after their video and are undone
+		// together with it.
+		videos := c.Schedule[len(c.Schedule)-1:]
+		if videos[0].ShortOf != "" && len(c.Schedule) > 1 {
+			videos = c.Schedule[len(c.Schedule)-2:]
+		}
+		for _, v := range videos {
+			if v.State == Published {
+				userError(Err_PublishedVideo)
+			}
 		}
+		vid := videos[0]
 
 		// Unschedule art and track associated with the video
-		if track, ok := c.Find(vid.Audio); ok {
-			track.(*Track).State = Buffered
+		for _, id := range vid.AudioIds() {
+			if track, ok := c.Find(id); ok {
+				track.(*Track).State = Buffered
+			}
 		}
-		if art, ok := c.Find(vid.Image); ok {
-			art.(*Artwork).State = Buffered
+		for _, id := range vid.ImageIds() {
+			if art, ok := c.Find(id); ok {
+				art.(*Artwork).State = Buffered
+			}
 		}
 
-		// Remove rendered video
-		c.Schedule = c.Schedule[:len(c.Schedule)-1]
-		os.Remove(vid.Path)
+		// Remove rendered videos
+		for _, v := range videos {
+			removeFile(v.Path, self.DryRun)
+			for _, variant := range v.Variants {
+				removeFile(variant.Path, self.DryRun)
+			}
+		}
+		c.Schedule = c.Schedule[:len(c.Schedule)-len(videos)]
 		userLog("undo:", vid.Title)
 
 	case "list":
@@ -107,52 +178,411 @@ func (self *ScheduleCommand) Exec(c *Collections) {
 
 	default:
 		// Create schedule by rendering all buffered items in schedule
-		self.renderAll(c)
+		self.renderAll(ctx, c)
 	}
 }
 
-func (self *ScheduleCommand) renderAll(c *Collections) int {
-	schedule, err := NewSchedule(c)
-	if err != nil {
-		userError(err.Error())
-	}
-
+func (self *ScheduleCommand) renderAll(ctx context.Context, c *Collections) int {
 	startTime, ok := latestScheduledTime(c)
 	now := time.Now()
 	if !ok {
 		startTime = now
 	}
 
+	tasks := self.scheduleTasks(ctx, c, startTime, now)
+	if tasks == nil {
+		return 0
+	}
+	if self.DryRun {
+		if failed := self.planRender(tasks); failed > 0 {
+			userError(Err_DryRun, failed)
+		}
+		return 0
+	}
+	self.renderVideos(ctx, tasks)
+	count := 0
+	cancelled := 0
+	var scheduled *Video
+	// Slots are given in order, shorts move with the video they were
+	// cut from.
+	slot := 0
+	var shift time.Duration
+
+	for _, task := range tasks {
+		vid := task.job.Video
+		derived := task.short || task.variant != ""
+		if derived && scheduled == nil {
+			// The video the short or variant was rendered from failed
+			os.Remove(vid.Path)
+			continue
+		}
+		if !derived {
+			scheduled = nil
+			// Keep the measurement even if rendering failed afterwards
+			if task.job.Loudness != nil {
+				task.track.Loudness = task.job.Loudness
+			}
+		}
+		if task.err == context.Canceled {
+			cancelled++
+			continue
+		}
+		var verifyErr *VerifyError
+		if errors.As(task.err, &verifyErr) {
+			printError("render: %s\n%v", vid.Title, task.err)
+			if task.variant != "" {
+				// Keep the variant to be inspected next to the video
+				scheduled.Variants = append(scheduled.Variants, VideoVariant{
+					Name:  task.variant,
+					Path:  vid.Path,
+					Error: verifyErr.Reason,
+				})
+				continue
+			}
+			// Keep the video to be inspected but leave the track and
+			// artwork buffered.
+			vid.State = Failed
+			vid.Error = verifyErr.Reason
+			c.Schedule = append(c.Schedule, vid)
+			continue
+		}
+		if task.err != nil {
+			printError("render: %s\n%v", vid.Title, task.err)
+			continue
+		}
+
+		if task.variant != "" {
+			scheduled.Variants = append(scheduled.Variants, VideoVariant{
+				Name:      task.variant,
+				Path:      vid.Path,
+				RenderKey: task.job.Cache.Key,
+			})
+			continue
+		}
+		if !task.short {
+			task.track.State = Scheduled
+			for _, a := range task.art {
+				a.State = Scheduled
+			}
+			scheduled = vid
+
+			slot++
+			publishAt := self.publishTime(startTime, slot, now)
+			shift = publishAt.Sub(*vid.PublishAt)
+			vid.PublishAt = &publishAt
+		} else {
+			publishAt := vid.PublishAt.Add(shift)
+			vid.PublishAt = &publishAt
+		}
+		vid.RenderKey = task.job.Cache.Key
+		vid.State = Scheduled
+		c.Schedule = append(c.Schedule, vid)
+		count++
+	}
+
+	if cancelled > 0 {
+		userLog("interrupt:", "%d videos were not rendered", cancelled)
+	}
+	return count
+}
+
+// Plan the render of each scheduled video followed by its variants and
+// short. Videos are published in the slots after start, nil is returned
+// when ctx is cancelled.
+func (self *ScheduleCommand) scheduleTasks(ctx context.Context, c *Collections, start, now time.Time) []renderTask {
+	schedule, err := NewSchedule(c)
+	if err != nil {
+		userError(err.Error())
+	}
+
+	tasks := make([]renderTask, 0, schedule.Count)
+	taken := make(map[string]bool)
+
 	// Schedule has items in reverse order such that the most recent
 	// tracks are in the beggining, we want to upload videos in
-	// chronological order.
-	for i := schedule.Count - 1; i >= 0; i-- {
-		track := schedule.Tracks[i]
-		art := schedule.Artwork[i]
+	// chronological order. Videos are named and tagged with the time
+	// slot they are planned for, slots are given to the videos that
+	// rendered successfully once rendering is done.
+	for i := 0; i < schedule.Count; i++ {
+		track := schedule.Tracks[schedule.Count-i-1]
+		art := schedule.Artwork[schedule.Count-i-1]
+
+		profile := RenderProfile{
+			Name:       self.profileName(track, art[0]),
+			Visualizer: track.Visualizer,
+		}
+		editor, err := self.Editor(profile)
+		if err != nil {
+			userError(err.Error())
+		}
+
+		publishAt := self.publishTime(start, i+1, now)
 
-		build := VideoBuilder{track, art, &self.Format, self.Editor.FileFormat}
+		build := VideoBuilder{
+			Track:     track,
+			Art:       art,
+			Format:    &self.Format,
+			Extension: editor.FileFormat,
+			Chapters:  trackChapters(track),
+			PublishAt: &publishAt,
+			Taken:     taken,
+			DryRun:    self.DryRun,
+		}
 		vid, err := build.Video(c, self.DataDir)
 		if err != nil {
 			userError(err.Error())
 		}
+		tags, err := build.Tags()
+		if err != nil {
+			userError(err.Error())
+		}
+		vid.Profile = profile.Name
+		// Probing is read-only and also done in a dry run, shorts are
+		// planned from the duration.
+		if track.Duration == 0 || track.Codec == "" {
+			if info, err := editor.Probe(track.Path); err == nil {
+				track.Duration = info.Duration()
+				if s, ok := info.Stream("audio"); ok {
+					track.Codec = s.CodecName
+				}
+			}
+		}
 
-		timeSlot := self.scheduleTime(startTime, schedule.Count-i)
-		if timeSlot.After(now) {
-			vid.PublishAt = &timeSlot
-		} else {
-			vid.PublishAt = &now
+		tasks = append(tasks, renderTask{
+			editor:  editor,
+			profile: profile,
+			track:   track,
+			art:     art,
+			job: RenderJob{
+				Video:      vid,
+				Duration:   track.Trim.Length(track.Duration),
+				AudioCodec: track.Codec,
+				Trim:       track.Trim,
+				Loudness:   track.Loudness,
+				Template:   build.Template(),
+				Tags:       tags,
+				LogPath:    self.logPath(vid),
+			},
+		})
+		parent := len(tasks) - 1
+		tasks = append(tasks, self.variantTasks(&tasks[parent])...)
+
+		if self.Options.Shorts {
+			short, err := self.shortTask(ctx, c, &tasks[parent])
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				printError("short: %s\n%v", vid.Title, err)
+				continue
+			}
+			tasks = append(tasks, short)
 		}
+	}
+	return tasks
+}
 
-		if err = self.Editor.Render(vid); err != nil {
-			userError(err.Error())
+// Render videos using a pool of at most Options.Jobs ffmpeg processes,
+// the render error for each video is stored in its task. Videos that
+// have not started rendering when ctx is cancelled are skipped.
+func (self *ScheduleCommand) renderVideos(ctx context.Context, tasks []renderTask) {
+	labels := make([]string, len(tasks))
+	for i, t := range tasks {
+		labels[i] = t.job.Video.Title
+	}
+
+	workers := self.Options.Jobs
+	if workers < 1 {
+		workers = 1
+	}
+
+	board := newProgressBoard("render:", labels)
+	board.Start()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				self.renderTask(ctx, board, tasks, i, nil)
+			}
+		}()
+	}
+	for w := range self.Workers {
+		remote := &self.Workers[w]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if !self.renderTask(ctx, board, tasks, i, remote) {
+					// Leave the remaining videos to the other workers
+					return
+				}
+			}
+		}()
+	}
+
+	for i := range tasks {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	board.Stop()
+}
+
+// Render a task locally or on a remote worker, a task is rendered
+// locally when the worker is unavailable in which case false is
+// returned.
+func (self *ScheduleCommand) renderTask(ctx context.Context, board *progressBoard, tasks []renderTask, i int, remote *RemoteWorker) bool {
+	task := &tasks[i]
+	if task.err = ctx.Err(); task.err != nil {
+		board.Update(i, TaskFailed, "(cancelled)")
+		return true
+	}
+
+	board.Update(i, TaskRunning, "")
+	task.job.Progress = func(status RenderStatus) {
+		board.Update(i, TaskRunning, status.String())
+	}
+	task.job.Cache = RenderCache{
+		Dir:   filepath.Join(self.DataDir, "cache"),
+		Force: self.Options.Force,
+	}
+
+	available := true
+	rctx, cancel := withTimeout(ctx, self.RenderTimeout)
+	task.err = self.prepareSlides(rctx, task)
+	if task.err == nil && remote != nil {
+		available, task.err = self.renderRemote(rctx, board, task, i, remote)
+	} else if task.err == nil {
+		task.err = task.editor.Render(rctx, &task.job)
+	}
+	cancel()
+
+	if task.err == context.DeadlineExceeded {
+		task.err = fmt.Errorf(Err_Timeout, self.RenderTimeout)
+	}
+	if task.err != nil {
+		board.Update(i, TaskFailed, "")
+		return available
+	}
+	board.Update(i, TaskDone, "")
+	return available
+}
+
+// Render a task on a remote worker unless it is in the local render
+// cache, the video is tagged, verified and added to the cache locally.
+func (self *ScheduleCommand) renderRemote(ctx context.Context, board *progressBoard, task *renderTask, i int, remote *RemoteWorker) (bool, error) {
+	done, err := task.editor.RestoreRender(ctx, &task.job)
+	if err != nil || done {
+		return true, err
+	}
+
+	board.Update(i, TaskRunning, fmt.Sprintf("(%s)", remote.URL))
+	err = remote.Render(ctx, task.profile, &task.job)
+	if _, ok := err.(*WorkerError); ok {
+		board.Update(i, TaskRunning, "(worker unavailable)")
+		return false, task.editor.Render(ctx, &task.job)
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, task.editor.FinishRender(ctx, &task.job)
+}
+
+// Fit each artwork of a video to the canvas of the task's editor
+func (self *ScheduleCommand) prepareSlides(ctx context.Context, task *renderTask) error {
+	task.job.Slides = make([]Slide, len(task.art))
+	for i, art := range task.art {
+		frame, err := task.editor.PrepareArtwork(
+			ctx, art, filepath.Join(self.DataDir, ".frames"))
+		if err != nil {
+			return err
+		}
+		task.job.Slides[i] = Slide{
+			Image:    frame,
+			Duration: art.Duration,
+			Motion:   art.Motion,
+			Rate:     art.FrameRate(),
 		}
+	}
+	return nil
+}
 
-		track.State = Scheduled
-		art.State = Scheduled
-		vid.State = Scheduled
-		c.Schedule = append(c.Schedule, vid)
+// Copy the artwork of a video for a task rendering it to another canvas.
+// Tasks fit artwork concurrently and only the frame fitted for the video
+// itself is kept on the artwork.
+func copyArtwork(art []*Artwork) []*Artwork {
+	copies := make([]*Artwork, len(art))
+	for i, a := range art {
+		a := *a
+		copies[i] = &a
 	}
-	return schedule.Count
+	return copies
+}
+
+// Path of the file ffmpeg output is written to when rendering a video
+func (self *ScheduleCommand) logPath(video *Video) string {
+	name := filepath.Base(video.Path)
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + ".log"
+	return filepath.Join(self.DataDir, "logs", name)
+}
+
+// Build the editor a task is rendered with from its profile
+func (self *ScheduleCommand) Editor(profile RenderProfile) (Editor, error) {
+	editor, err := self.Profile(profile.Name)
+	if err != nil {
+		return Editor{}, err
+	}
+	if profile.Visualizer != "" {
+		editor.Visualizer.Preset = profile.Visualizer
+	}
+	if profile.Short {
+		// Configs written before shorts have no vertical canvas
+		editor.Canvas = self.Shorts.Canvas
+		if editor.Canvas == "" {
+			editor.Canvas = defaultConfig.Shorts.Canvas
+		}
+		editor.Fit = self.Shorts.Fit
+		if editor.Fit == "" {
+			editor.Fit = defaultConfig.Shorts.Fit
+		}
+	}
+	if profile.Variant == "" {
+		return editor, nil
+	}
+	for _, v := range editor.Variants {
+		if v.Name == profile.Variant {
+			return v.editor(editor), nil
+		}
+	}
+	return Editor{}, fmt.Errorf(Err_UnknownVariant, profile.Variant)
+}
+
+// Select the render profile for a video, a profile passed to schedule
+// takes priority over the track profile which takes priority over the
+// artwork profile. An empty name selects the default profile.
+func (self *ScheduleCommand) profileName(track *Track, art *Artwork) string {
+	if self.Options.Profile != "" {
+		return self.Options.Profile
+	}
+	if track.Profile != "" {
+		return track.Profile
+	}
+	return art.Profile
+}
+
+// Time the video in the given slot after start is published, videos
+// whose slot has passed are published right away.
+func (self *ScheduleCommand) publishTime(start time.Time, pos int, now time.Time) time.Time {
+	t := self.scheduleTime(start, pos)
+	if !t.After(now) {
+		return now
+	}
+	return t
 }
 
 func (self *ScheduleCommand) scheduleTime(start time.Time, pos int) time.Time {
@@ -186,6 +616,9 @@ func latestScheduledTime(c *Collections) (time.Time, bool) {
 	// Most recent videos are at the end of the collection
 	for i := count - 1; i >= 1; i-- {
 		video := c.Schedule[i]
+		if video.State == Failed {
+			continue
+		}
 		if video.PublishAt.After(latest) {
 			latest = *video.PublishAt
 		}
@@ -220,5 +653,11 @@ func printSchedule(schedule []*Video, start int) {
 		}
 		i += 1
 		fmt.Printf("%d. %s\n", i, v)
+		for _, variant := range v.Variants {
+			fmt.Printf("   %s: %s\n", variant.Name, variant.Path)
+			if variant.Error != "" {
+				fmt.Printf("   %s failed verification: %s\n", variant.Name, variant.Error)
+			}
+		}
 	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const Err_Highlight = "Could not find a highlight in '%s' (%v)."
+
+// Vertical videos rendered next to each video by schedule --shorts.
+// The artwork is fitted to Canvas with Fit, and the most intense
+// Duration seconds of the track are used. Shorts are published Delay
+// after the video they were cut from.
+type Shorts struct {
+	Profile  string
+	Canvas   string
+	Fit      string
+	Duration float64
+	FadeIn   float64
+	FadeOut  float64
+	Delay    string
+}
+
+// Length of the windows audio energy is measured over in seconds, and
+// the sample rate audio is decoded at for the measurement.
+const (
+	energyWindow = 0.5
+	energyRate   = 8000
+)
+
+// Maximum duration of a YouTube short
+const maxShortDuration = 60
+
+// Plan a short cut from the video rendered by task. The short is a
+// separate video with its own title, published after the video.
+func (self *ScheduleCommand) shortTask(ctx context.Context, c *Collections, task *renderTask) (renderTask, error) {
+	track := task.track
+	profile := RenderProfile{
+		Name:       self.Shorts.Profile,
+		Visualizer: track.Visualizer,
+		Short:      true,
+	}
+	editor, err := self.Editor(profile)
+	if err != nil {
+		return renderTask{}, err
+	}
+
+	length := math.Min(self.Shorts.Duration, maxShortDuration)
+	if length <= 0 {
+		length = maxShortDuration
+	}
+	start := 0.0
+	full := track.Trim.Length(track.Duration)
+	if full > length {
+		// A dry run does not decode the track to find the highlight
+		if !self.DryRun {
+			energy, err := editor.AudioEnergy(ctx, track.Path, track.Trim)
+			if err != nil {
+				return renderTask{}, fmt.Errorf(Err_Highlight, track.Path, err)
+			}
+			start = float64(highlight(energy, int(length/energyWindow))) * energyWindow
+		}
+	} else if full > 0 {
+		// An unknown duration keeps the configured length
+		length = full
+	}
+
+	delay := time.Hour
+	if self.Shorts.Delay != "" {
+		if delay, err = time.ParseDuration(self.Shorts.Delay); err != nil {
+			return renderTask{}, fmt.Errorf(Err_InvalidTimeout, self.Shorts.Delay)
+		}
+	}
+	publishAt := task.job.Video.PublishAt.Add(delay)
+
+	format := self.Format
+	format.Title = format.ShortTitle
+	if format.Title == "" {
+		// Configs written before shorts have no short title
+		format.Title = defaultConfig.VideoFormat.ShortTitle
+	}
+	build := VideoBuilder{
+		Track:     track,
+		Art:       task.art,
+		Format:    &format,
+		Extension: editor.FileFormat,
+		PublishAt: &publishAt,
+	}
+	vid, err := build.Video(c, "")
+	if err != nil {
+		return renderTask{}, err
+	}
+	tags, err := build.Tags()
+	if err != nil {
+		return renderTask{}, err
+	}
+	// Shorts are saved next to the video they were cut from
+	parent := task.job.Video.Path
+	vid.Path = strings.TrimSuffix(parent, filepath.Ext(parent)) + ".short" + editor.FileFormat
+	vid.Profile = self.Shorts.Profile
+	vid.ShortOf = task.job.Video.UniqueId()
+
+	trim := Trim{
+		Start:   track.Trim.Start + start,
+		End:     track.Trim.Start + start + length,
+		FadeIn:  self.Shorts.FadeIn,
+		FadeOut: self.Shorts.FadeOut,
+	}
+	return renderTask{
+		editor:  editor,
+		profile: profile,
+		track:   track,
+		art:     copyArtwork(task.art),
+		short:   true,
+		job: RenderJob{
+			Video:      vid,
+			Duration:   length,
+			AudioCodec: track.Codec,
+			Trim:       trim,
+			Template:   build.Template(),
+			Tags:       tags,
+			LogPath:    self.logPath(vid),
+		},
+	}, nil
+}
+
+// Measure the RMS energy of the trimmed audio of a file for each window
+// of energyWindow seconds. Audio is decoded by ffmpeg to mono samples.
+func (self *Editor) AudioEnergy(ctx context.Context, path string, trim Trim) ([]float64, error) {
+	args := []string{"-hide_banner", "-nostats", "-v", "error"}
+	if trim.Start > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%g", trim.Start))
+	}
+	if trim.End > 0 {
+		args = append(args, "-to", fmt.Sprintf("%g", trim.End))
+	}
+	args = append(args, "-i", path, "-vn", "-ac", "1",
+		"-ar", fmt.Sprint(energyRate), "-f", "s16le", "-acodec", "pcm_s16le", "pipe:1")
+
+	cmd := exec.CommandContext(ctx, self.Path, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	energy, readErr := readEnergy(bufio.NewReader(stdout), int(energyRate*energyWindow))
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ffmpeg: %v", err)
+	}
+	return energy, readErr
+}
+
+// Read 16 bit little endian samples and return the RMS of every window
+// of n samples, a partial window at the end is included.
+func readEnergy(r io.Reader, n int) ([]float64, error) {
+	var energy []float64
+	var sum float64
+	count := 0
+	buf := make([]byte, 2)
+
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		v := float64(int16(binary.LittleEndian.Uint16(buf))) / 32768
+		sum += v * v
+		count++
+		if count == n {
+			energy = append(energy, math.Sqrt(sum/float64(count)))
+			sum, count = 0, 0
+		}
+	}
+	if count > 0 {
+		energy = append(energy, math.Sqrt(sum/float64(count)))
+	}
+	return energy, nil
+}
+
+// Index of the first of n consecutive windows with the highest total
+// energy, the earliest section wins a tie.
+func highlight(energy []float64, n int) int {
+	if n <= 0 || len(energy) <= n {
+		return 0
+	}
+	sum := 0.0
+	for _, e := range energy[:n] {
+		sum += e
+	}
+	best, bestSum := 0, sum
+	for i := n; i < len(energy); i++ {
+		sum += energy[i] - energy[i-n]
+		if sum > bestSum {
+			best, bestSum = i-n+1, sum
+		}
+	}
+	return best
+}
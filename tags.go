@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Container metadata written into rendered files. Title and description
+// are those of the video, Cover embeds the artwork as cover art.
+type Metadata struct {
+	Enabled bool
+	Cover   bool
+}
+
+// Values of the metadata tags of a video, the title, description and
+// publish date are added when the video is rendered.
+func (self *VideoBuilder) Tags() (Template, error) {
+	artists := strings.Join(self.Track.Artists, ", ")
+	tags := Template{
+		"artist":       self.Track.By,
+		"album_artist": self.Track.By,
+	}
+	if self.Track.By == "" {
+		tags["artist"] = artists
+		tags["album_artist"] = artists
+	}
+	if self.Format.Album != "" {
+		album, err := buildTemplate(self.Format.Album, self.Template())
+		if err != nil {
+			return nil, err
+		}
+		tags["album"] = album
+	}
+	return tags, nil
+}
+
+// Tags of a rendered video, empty values are left out
+func videoTags(job *RenderJob) Template {
+	video := job.Video
+	tags := Template{
+		"title":       video.Title,
+		"description": video.Description,
+		"comment":     video.Description,
+	}
+	if video.PublishAt != nil {
+		tags["date"] = video.PublishAt.Format("2006-01-02")
+	}
+	for k, v := range job.Tags {
+		tags[k] = v
+	}
+	for k, v := range tags {
+		if v == "" {
+			delete(tags, k)
+		}
+	}
+	return tags
+}
+
+// Build the ffmpeg arguments copying src to dst with metadata tags and
+// an optional cover image. Images other than png and jpeg are converted
+// to a single png frame.
+func tagArgs(src, dst, cover string, tags Template) []string {
+	args := []string{"-i", src}
+	if cover != "" {
+		args = append(args, "-i", cover)
+	}
+	args = append(args, "-map", "0")
+	if cover != "" {
+		args = append(args, "-map", "1:v")
+	}
+	args = append(args, "-c", "copy")
+	if cover != "" {
+		if format, _ := sniffImage(cover); format != "png" && format != "jpeg" {
+			args = append(args, "-c:v:1", "png", "-frames:v:1", "1")
+		}
+		args = append(args, "-disposition:v:1", "attached_pic")
+	}
+	if isFaststartFormat(dst) {
+		args = append(args, "-movflags", "+faststart")
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-metadata", fmt.Sprintf("%s=%s", k, tags[k]))
+	}
+	return append(args, "-y", dst)
+}
+
+// Write metadata tags into a rendered file. The file is copied with the
+// tags to a temporary file which then replaces it.
+func (self *Editor) writeTags(ctx context.Context, job *RenderJob, path string) error {
+	tmp := tagTempPath(path)
+	defer os.Remove(tmp)
+
+	var logPath string
+	if job.LogPath != "" {
+		logPath = strings.TrimSuffix(job.LogPath, ".log") + ".tags.log"
+	}
+	args := self.tagCommand(job, path)
+	if err := runFfmpeg(ctx, self.Path, args, job.Duration, logPath, job.Progress); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Build the ffmpeg arguments writing the tags of a job into the file at
+// path, see writeTags.
+func (self *Editor) tagCommand(job *RenderJob, path string) []string {
+	var cover string
+	if self.Metadata.Cover {
+		cover = job.Video.Image
+	}
+	return tagArgs(path, tagTempPath(path), cover, videoTags(job))
+}
+
+// Path a video is copied to while metadata tags are written
+func tagTempPath(output string) string {
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + ".tags" + ext
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	Err_InvalidTrim   = "Trim end (%gs) must be after the start (%gs)."
+	Err_DetectSilence = "Could not detect silence in '%s' (%v)."
+)
+
+// Part of a track used in the video, in seconds from the start of the
+// audio file. End is zero to play until the end of the file. Fades are
+// applied after trimming.
+type Trim struct {
+	Start   float64
+	End     float64
+	FadeIn  float64
+	FadeOut float64
+}
+
+// Silence shorter than Duration seconds or louder than Threshold dB is
+// not trimmed by silence detection.
+type Silence struct {
+	Threshold float64
+	Duration  float64
+}
+
+type silenceRange struct {
+	start, end float64
+}
+
+// Length of the trimmed audio given the duration of the file, zero if
+// the duration is unknown.
+func (self *Trim) Length(duration float64) float64 {
+	end := duration
+	if self.End > 0 && (duration == 0 || self.End < duration) {
+		end = self.End
+	}
+	if end <= 0 {
+		return 0
+	}
+	return end - self.Start
+}
+
+func (self *Trim) apply(g *filterGraph) error {
+	if self.End > 0 && self.End <= self.Start {
+		return fmt.Errorf(Err_InvalidTrim, self.End, self.Start)
+	}
+	if self.Start > 0 || self.End > 0 {
+		trim := fmt.Sprintf("atrim=start=%g", self.Start)
+		if self.End > 0 {
+			trim += fmt.Sprintf(":end=%g", self.End)
+		}
+		g.AudioFilter(trim + ",asetpts=PTS-STARTPTS")
+	}
+	return nil
+}
+
+// Fades are applied separately from trimming so they also apply to the
+// normalized audio, duration is the length of the trimmed audio.
+func (self *Trim) applyFades(g *filterGraph, duration float64) error {
+	var fades []string
+	if self.FadeIn > 0 {
+		fades = append(fades, fmt.Sprintf("afade=t=in:st=0:d=%g", self.FadeIn))
+	}
+	if self.FadeOut > 0 {
+		if duration <= 0 {
+			return fmt.Errorf(Err_UnknownDuration, "a fade out")
+		}
+		start := duration - self.FadeOut
+		if start < 0 {
+			start = 0
+		}
+		fades = append(fades, fmt.Sprintf("afade=t=out:st=%g:d=%g", start, self.FadeOut))
+	}
+	if len(fades) > 0 {
+		g.AudioFilter(strings.Join(fades, ","))
+	}
+	return nil
+}
+
+// Find leading and trailing silence in an audio file, returning trim
+// points that cut it. End is zero if the track does not end in silence.
+func (self *Editor) DetectSilence(ctx context.Context, path string) (Trim, error) {
+	info, err := self.Probe(path)
+	if err != nil {
+		return Trim{}, err
+	}
+	duration := info.Duration()
+
+	threshold, minDuration := self.Silence.Threshold, self.Silence.Duration
+	if threshold == 0 {
+		threshold = -50
+	}
+	if minDuration <= 0 {
+		minDuration = 0.5
+	}
+
+	filter := fmt.Sprintf("silencedetect=n=%gdB:d=%g", threshold, minDuration)
+	cmd := exec.CommandContext(ctx, self.Path,
+		"-hide_banner", "-nostats", "-i", path, "-vn", "-af", filter, "-f", "null", "-")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return Trim{}, ctx.Err()
+		}
+		return Trim{}, fmt.Errorf("ffmpeg: %v", err)
+	}
+	return silenceTrim(parseSilence(stderr.Bytes()), duration), nil
+}
+
+// Parse silence_start and silence_end lines printed by silencedetect,
+// silence running until the end of the file may not have an end.
+func parseSilence(out []byte) []silenceRange {
+	var ranges []silenceRange
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "silence_start:"); i >= 0 {
+			v, err := strconv.ParseFloat(firstField(line[i+len("silence_start:"):]), 64)
+			if err == nil {
+				ranges = append(ranges, silenceRange{v, -1})
+			}
+		} else if i := strings.Index(line, "silence_end:"); i >= 0 && len(ranges) > 0 {
+			v, err := strconv.ParseFloat(firstField(line[i+len("silence_end:"):]), 64)
+			if err == nil {
+				ranges[len(ranges)-1].end = v
+			}
+		}
+	}
+	return ranges
+}
+
+func silenceTrim(ranges []silenceRange, duration float64) Trim {
+	var trim Trim
+	if len(ranges) == 0 {
+		return trim
+	}
+
+	// Small offsets are allowed since the first frame may not start at 0
+	first := ranges[0]
+	if first.start <= 0.05 && first.end > 0 {
+		trim.Start = first.end
+	}
+
+	last := ranges[len(ranges)-1]
+	if last.end < 0 || (duration > 0 && last.end >= duration-0.05) {
+		if last.start > trim.Start {
+			trim.End = last.start
+		}
+	}
+	return trim
+}
+
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
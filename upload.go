@@ -10,6 +10,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -31,10 +33,17 @@ type UploadCommand struct {
 	ClientSecret string
 	RootPath     string
 	Metadata     UploadMetadata
+	Timeout      time.Duration
+	// Print the requests that would be sent without uploading
+	DryRun bool
 }
 
-func (self *UploadCommand) Exec(c *Collections) {
+func (self *UploadCommand) Exec(ctx context.Context, c *Collections) {
 	videos := findVideosToUpload(c)
+	if self.DryRun {
+		self.planUpload(c, videos)
+		return
+	}
 	client := self.getClient(youtube.YoutubeUploadScope)
 
 	service, err := youtube.New(client)
@@ -43,20 +52,52 @@ func (self *UploadCommand) Exec(c *Collections) {
 	}
 
 	for _, v := range videos {
-		self.ytUpload(service, v)
+		if ctx.Err() != nil {
+			return
+		}
+
+		linkShort(c, v)
+
+		// Stop uploading on the first error, videos that were already
+		// uploaded are still saved as published.
+		if err := self.ytUpload(ctx, service, v); err != nil {
+			if ctx.Err() == nil {
+				printError("upload: Failed to upload %s\n%v", v.Path, err)
+			}
+			return
+		}
 		v.State = Published
 
-		if track, ok := c.Find(v.Audio); ok {
-			track.(*Track).State = Published
+		for _, id := range v.AudioIds() {
+			if track, ok := c.Find(id); ok {
+				track.(*Track).State = Published
+			}
 		}
 
-		if art, ok := c.Find(v.Image); ok {
-			art.(*Artwork).State = Published
+		for _, id := range v.ImageIds() {
+			if art, ok := c.Find(id); ok {
+				art.(*Artwork).State = Published
+			}
 		}
 	}
 }
 
-func (self *UploadCommand) ytUpload(service *youtube.Service, video *Video) {
+func (self *UploadCommand) ytUpload(ctx context.Context, service *youtube.Service, video *Video) error {
+	upload := self.uploadBody(video)
+
+	ctx, cancel := withTimeout(ctx, self.Timeout)
+	defer cancel()
+
+	call := service.Videos.Insert("snippet,status", upload)
+	err := publishVideo(ctx, call, video)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf(Err_Timeout, self.Timeout)
+	}
+	return err
+}
+
+// Body of the request inserting a video
+func (self *UploadCommand) uploadBody(video *Video) *youtube.Video {
 	upload := &youtube.Video{
 		Snippet: &youtube.VideoSnippet{
 			Title:       video.Title,
@@ -77,28 +118,31 @@ func (self *UploadCommand) ytUpload(service *youtube.Service, video *Video) {
 		upload.Status.PrivacyStatus = "private"
 		upload.Status.PublishAt = video.PublishAt.Format(ISO8601)
 	}
-
-	call := service.Videos.Insert("snippet,status", upload)
-	publishVideo(call, video)
+	return upload
 }
 
-func publishVideo(call *youtube.VideosInsertCall, video *Video) {
+func publishVideo(ctx context.Context, call *youtube.VideosInsertCall, video *Video) error {
 	file, err := os.Open(video.Path)
-	defer file.Close()
 	if err != nil {
-		userError("upload: Unable to open %s\n%v", video.Path, err)
+		return err
 	}
+	defer file.Close()
 
 	stop := make(chan bool)
 	go userProgress(stop, "upload:", "%s", video)
 
-	res, err := call.Media(file).Do()
+	res, err := call.Media(file).Context(ctx).Do()
 	stop <- true
 	if err != nil {
-		userError("\nupload: Failed to upload %s\n%v", video.Path, err)
+		fmt.Println()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
 	}
 	video.UploadId = &res.Id
 	userLogRepl("upload:", "%s\n", video)
+	return nil
 }
 
 func (self *UploadCommand) getClient(scope string) *http.Client {
@@ -221,6 +265,22 @@ func saveToken(file string, token *oauth2.Token) {
 	json.NewEncoder(fp).Encode(token)
 }
 
+// Link a short to the video it was cut from, shorts are published after
+// their video so it should already be uploaded.
+func linkShort(c *Collections, short *Video) {
+	if short.ShortOf == "" {
+		return
+	}
+	col, ok := c.Find(short.ShortOf)
+	if !ok || col.(*Video).UploadId == nil {
+		return
+	}
+	link := "Full video: https://youtu.be/" + *col.(*Video).UploadId
+	if !strings.Contains(short.Description, link) {
+		short.Description = link + "\n\n" + short.Description
+	}
+}
+
 func findVideosToUpload(c *Collections) []*Video {
 	videos := []*Video{}
 	for _, v := range c.Schedule {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const Err_UnknownVariant = "Unknown variant '%s'."
+
+// An extra output rendered next to each video, such as a square video
+// for other platforms. Canvas sets the size and aspect ratio of the
+// output and Fit how the artwork is fitted to it. Videos longer than
+// MaxDuration seconds are cut and faded out over FadeOut seconds.
+type Variant struct {
+	Name         string
+	Canvas       string
+	Fit          string
+	MaxDuration  float64
+	FadeOut      float64
+	VideoBitrate string
+	AudioBitrate string
+}
+
+// A rendered variant of a video, Error is the reason a variant that is
+// kept to be inspected did not pass verification.
+type VideoVariant struct {
+	Name      string
+	Path      string
+	RenderKey string
+	Error     string
+}
+
+// Editor rendering the variant, based on the editor of the video
+func (self *Variant) editor(base Editor) Editor {
+	editor := base
+	editor.Variants = nil
+	if self.Canvas != "" {
+		editor.Canvas = self.Canvas
+	}
+	if self.Fit != "" {
+		editor.Fit = self.Fit
+	}
+	if self.VideoBitrate != "" {
+		editor.OutputArgs += " -b:v " + self.VideoBitrate
+		editor.LoopOutputArgs += " -b:v " + self.VideoBitrate
+	}
+	if self.AudioBitrate != "" {
+		editor.AudioBitrate = self.AudioBitrate
+	}
+	return editor
+}
+
+// Trim of the variant, the track is cut after MaxDuration seconds
+func (self *Variant) trim(track *Track) Trim {
+	trim := track.Trim
+	if self.MaxDuration > 0 && trim.Length(track.Duration) > self.MaxDuration {
+		trim.End = trim.Start + self.MaxDuration
+		trim.FadeOut = self.FadeOut
+	}
+	return trim
+}
+
+// Path a variant of a video is rendered to
+func variantPath(video *Video, name string) string {
+	ext := filepath.Ext(video.Path)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(video.Path, ext), name, ext)
+}
+
+// Plan the variants declared by the editor of a task, each variant
+// renders the same video to its own file.
+func (self *ScheduleCommand) variantTasks(task *renderTask) []renderTask {
+	var tasks []renderTask
+	for i := range task.editor.Variants {
+		v := &task.editor.Variants[i]
+		vid := *task.job.Video
+		vid.Title = fmt.Sprintf("%s [%s]", vid.Title, v.Name)
+		vid.Path = variantPath(task.job.Video, v.Name)
+
+		trim := v.trim(task.track)
+		job := task.job
+		job.Video = &vid
+		job.Trim = trim
+		job.Duration = trim.Length(task.track.Duration)
+		job.LogPath = self.logPath(&vid)
+
+		profile := task.profile
+		profile.Variant = v.Name
+		tasks = append(tasks, renderTask{
+			editor:  v.editor(task.editor),
+			profile: profile,
+			track:   task.track,
+			art:     copyArtwork(task.art),
+			job:     job,
+			variant: v.Name,
+		})
+	}
+	return tasks
+}
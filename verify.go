@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const Err_Verify = "Rendered video '%s' failed verification (%s)."
+
+// Checks run on every rendered file. The duration of the file may differ
+// from the duration of the audio by at most Tolerance seconds.
+type Verify struct {
+	Enabled   bool
+	Tolerance float64
+}
+
+// A rendered file that failed verification, the file is kept so it can
+// be inspected.
+type VerifyError struct {
+	Path   string
+	Reason string
+}
+
+func (self *VerifyError) Error() string {
+	return fmt.Sprintf(Err_Verify, self.Path, self.Reason)
+}
+
+// Containers that need the moov atom before the media data to be
+// processed while they are uploaded.
+var faststartFormats = [...]string{".mp4", ".m4v", ".mov"}
+
+func isFaststartFormat(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range faststartFormats {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that a rendered video has video and audio streams, the duration
+// of the audio with any intro and outro clips, the canvas resolution and
+// the moov atom at the front.
+func (self *Editor) VerifyRender(job *RenderJob, path string) error {
+	info, err := self.Probe(path)
+	if err != nil {
+		return &VerifyError{path, err.Error()}
+	}
+	duration := job.Duration
+	if duration > 0 && self.Branding.hasBumpers() {
+		extra, err := self.bumperDuration()
+		if err != nil {
+			return &VerifyError{path, err.Error()}
+		}
+		duration += extra
+	}
+	if reason := self.verifyInfo(info, duration); reason != "" {
+		return &VerifyError{path, reason}
+	}
+
+	if !isFaststartFormat(path) {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return &VerifyError{path, err.Error()}
+	}
+	defer file.Close()
+	first, err := moovFirst(bufio.NewReader(file))
+	if err != nil {
+		return &VerifyError{path, err.Error()}
+	}
+	if !first {
+		return &VerifyError{path, "moov atom is not at the front of the file"}
+	}
+	return nil
+}
+
+// Reason the probed file does not match the render, empty if it does.
+// The duration is not checked when it is unknown.
+func (self *Editor) verifyInfo(info *MediaInfo, duration float64) string {
+	video, ok := info.Stream("video")
+	if !ok {
+		return "no video stream"
+	}
+	if _, ok := info.Stream("audio"); !ok {
+		return "no audio stream"
+	}
+
+	if duration > 0 {
+		got := info.Duration()
+		if math.Abs(got-duration) > self.Verify.Tolerance {
+			return fmt.Sprintf("duration is %.1fs, expected %.1fs", got, duration)
+		}
+	}
+
+	// Artwork is only scaled to the canvas when it is fitted
+	if self.Canvas != "" && self.Fit != "" {
+		w, h, err := parseCanvas(self.Canvas)
+		if err != nil {
+			return err.Error()
+		}
+		if video.Width != w || video.Height != h {
+			return fmt.Sprintf("resolution is %dx%d, expected %dx%d",
+				video.Width, video.Height, w, h)
+		}
+	}
+	return ""
+}
+
+// Whether the moov atom of an mp4 file comes before the media data
+func moovFirst(r io.Reader) (bool, error) {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return false, fmt.Errorf("no moov atom")
+			}
+			return false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		skip := size - 8
+
+		switch string(header[4:]) {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+
+		if size == 1 {
+			// 64 bit size follows the atom type
+			if _, err := io.ReadFull(r, header); err != nil {
+				return false, err
+			}
+			skip = int64(binary.BigEndian.Uint64(header)) - 16
+		} else if size == 0 {
+			// The last atom extends to the end of the file
+			return false, fmt.Errorf("no moov atom")
+		}
+		if skip < 0 {
+			return false, fmt.Errorf("invalid atom size %d", size)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Err_WorkerUnavailable = "Render worker %s is unavailable (%s)."
+	Err_WorkerRender      = "Render worker %s failed to render (%s)."
+	Err_WorkerToken       = "A render worker listening on %s needs a token (set Worker.Token or listen on localhost)."
+)
+
+// A render worker videos are dispatched to by schedule. Inputs are
+// streamed to the worker unless Shared is set, in which case the worker
+// reads them from the same paths, such as a network share.
+type RemoteWorker struct {
+	URL    string
+	Token  string
+	Shared bool
+}
+
+// Settings of the render-worker server. Requests must carry Token as a
+// bearer token, which may only be empty when listening on localhost.
+// Shared inputs are only read from SharedRoots, and requests are limited
+// to MaxRequestMB megabytes.
+type WorkerConfig struct {
+	Addr         string
+	Token        string
+	SharedRoots  []string
+	MaxRequestMB int64
+}
+
+type WorkerOptions struct {
+	Addr string `opt:"-addr"`
+	Jobs int    `opt:"-j"`
+}
+
+// Serve render jobs over HTTP. Jobs are rendered with the render profiles
+// and shorts settings of Schedule, selected by the name sent by the
+// client. Tags are written, videos verified and renders cached by the
+// client.
+type RenderWorkerCommand struct {
+	DataDir  string
+	Schedule ScheduleCommand
+	Config   WorkerConfig
+	Options  WorkerOptions
+}
+
+// A worker that could not be reached or refused a job, the job can be
+// rendered somewhere else.
+type WorkerError struct {
+	URL    string
+	Reason string
+}
+
+func (self *WorkerError) Error() string {
+	return fmt.Sprintf(Err_WorkerUnavailable, self.URL, self.Reason)
+}
+
+// Job sent to a worker. Inputs are the paths of the input files in the
+// order they are streamed, empty when inputs are read from shared paths.
+type workerRequest struct {
+	Profile RenderProfile
+	Job     RenderJob
+	Inputs  []string
+}
+
+func (self *RenderWorkerCommand) Exec(ctx context.Context) {
+	addr := self.Options.Addr
+	if addr == "" {
+		addr = self.Config.Addr
+	}
+	if self.Config.Token == "" && !isLoopback(addr) {
+		userError(Err_WorkerToken, addr)
+	}
+	jobs := self.Options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	slots := make(chan bool, jobs)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/render", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- true:
+			defer func() { <-slots }()
+		case <-r.Context().Done():
+			return
+		}
+		self.serveRender(w, r)
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	userLog("worker:", "listening on %s", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		userError(err.Error())
+	}
+}
+
+// Whether a listen address only accepts connections from this machine
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (self *RenderWorkerCommand) serveRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	token := []byte("Bearer " + self.Config.Token)
+	auth := []byte(r.Header.Get("Authorization"))
+	if self.Config.Token != "" && subtle.ConstantTimeCompare(auth, token) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if self.Config.MaxRequestMB > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, self.Config.MaxRequestMB<<20)
+	}
+
+	dir, err := ioutil.TempDir("", "autoyt-render")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	req, err := readWorkerRequest(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := self.checkInputs(&req.Job, dir); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	editor, err := self.Schedule.Editor(req.Profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Tags are written and the video verified once it is returned
+	editor.Metadata = nil
+	editor.Verify = nil
+
+	job := req.Job
+	job.Video.Path = filepath.Join(dir, "output"+filepath.Ext(job.Video.Path))
+	job.Output = ""
+	if job.LogPath != "" {
+		name := sanitizeFileName(filepath.Base(job.LogPath))
+		job.LogPath = filepath.Join(self.DataDir, "logs", name)
+	}
+	// Cache keys include the input paths, which are new for every
+	// request, the returned video is cached by the client instead.
+	job.Cache = RenderCache{}
+
+	userLog("render:", "%s", job.Video.Title)
+	if err := editor.Render(r.Context(), &job); err != nil {
+		printError("render: %s\n%v", job.Video.Title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(job.Video.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	if info, err := file.Stat(); err == nil {
+		header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	io.Copy(w, file)
+}
+
+// Check that a job only reads the files streamed to dir or files under
+// the shared roots.
+func (self *RenderWorkerCommand) checkInputs(job *RenderJob, dir string) error {
+	roots := []string{dir}
+	for _, root := range self.Config.SharedRoots {
+		roots = append(roots, expandHomePath(root))
+	}
+	for _, p := range jobInputs(job) {
+		if *p == "" {
+			continue
+		}
+		if !isAbsPathIn(roots, *p) {
+			return fmt.Errorf("input '%s' is not in a shared root", *p)
+		}
+	}
+	return nil
+}
+
+// Whether an absolute path is inside one of the roots
+func isAbsPathIn(roots []string, path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	for _, root := range roots {
+		rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Read the job of a request and save the streamed inputs to dir, the
+// paths of the job are replaced with the saved files.
+func readWorkerRequest(r *http.Request, dir string) (*workerRequest, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(workerRequest)
+	files := make(map[string]string)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "job" {
+			if err := json.NewDecoder(part).Decode(req); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 || i >= len(req.Inputs) {
+			return nil, fmt.Errorf("unexpected part '%s'", name)
+		}
+		path := filepath.Join(dir, name+filepath.Ext(part.FileName()))
+		if err := saveFile(part, path); err != nil {
+			return nil, err
+		}
+		files[req.Inputs[i]] = path
+	}
+	if req.Job.Video == nil {
+		return nil, fmt.Errorf("missing job")
+	}
+
+	for _, p := range jobInputs(&req.Job) {
+		if _, ok := files[*p]; ok {
+			*p = files[*p]
+		}
+	}
+	return req, nil
+}
+
+func saveFile(r io.Reader, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Paths of the files a job reads from
+func jobInputs(job *RenderJob) []*string {
+	inputs := []*string{&job.Video.Audio, &job.Video.Image}
+	for i := range job.Slides {
+		inputs = append(inputs, &job.Slides[i].Image)
+	}
+	for i := range job.Segments {
+		inputs = append(inputs, &job.Segments[i].Path)
+	}
+	return inputs
+}
+
+// Render a job on the worker with the profile of that name on the worker
+// and write the video to the path of the video. The video is returned
+// without tags and is not verified, see Editor.FinishRender. Returns a
+// WorkerError when the job can be rendered elsewhere.
+func (self *RemoteWorker) Render(ctx context.Context, profile RenderProfile, job *RenderJob) error {
+	req := workerRequest{Profile: profile, Job: *job}
+	if !self.Shared {
+		seen := make(map[string]bool)
+		for _, p := range jobInputs(job) {
+			if *p != "" && !seen[*p] {
+				seen[*p] = true
+				req.Inputs = append(req.Inputs, *p)
+			}
+		}
+	}
+
+	body, writer := io.Pipe()
+	mw := multipart.NewWriter(writer)
+	go func() {
+		writer.CloseWithError(writeWorkerRequest(mw, &req))
+	}()
+
+	url := strings.TrimSuffix(self.URL, "/") + "/render"
+	r, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		body.Close()
+		return &WorkerError{self.URL, err.Error()}
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if self.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+self.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		body.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &WorkerError{self.URL, err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		reason := strings.TrimSpace(string(msg))
+		if resp.StatusCode == http.StatusInternalServerError {
+			return fmt.Errorf(Err_WorkerRender, self.URL, reason)
+		}
+		return &WorkerError{self.URL, fmt.Sprintf("%s: %s", resp.Status, reason)}
+	}
+
+	if err := saveFile(resp.Body, job.Video.Path); err != nil {
+		os.Remove(job.Video.Path)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Write the job followed by each input file
+func writeWorkerRequest(mw *multipart.Writer, req *workerRequest) error {
+	part, err := mw.CreateFormField("job")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(req); err != nil {
+		return err
+	}
+
+	for i, path := range req.Inputs {
+		part, err := mw.CreateFormFile(strconv.Itoa(i), filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}